@@ -0,0 +1,399 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/mailer"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/privacy"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	accountDeletionGrace = utils.GetEnvDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour)
+	accountPurgeInterval = utils.GetEnvDuration("ACCOUNT_PURGE_INTERVAL", time.Hour)
+	// how recent the login has to be to add a way into the account: a first password
+	// (see ChangePassword) or a passkey (see requireReauth)
+	passwordReauthMaxAge = utils.GetEnvDuration("PASSWORD_REAUTH_MAX_AGE", 10*time.Minute)
+)
+
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	resp := accountResponse(user)
+	resp.Permissions, _ = r.Context().Value(utils.Permissions).([]string)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func accountResponse(user models.User) models.AccountResponse {
+	identities := user.Identities
+	if identities == nil {
+		identities = []models.ExternalIdentity{}
+	}
+	return models.AccountResponse{
+		UserId:          user.UserID,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		Email:           user.Email,
+		Roles:           user.Roles,
+		FavouriteGenres: user.FavouriteGenres,
+		EmailVerified:   user.IsEmailVerified(),
+		TOTPEnabled:     user.TOTPEnabled,
+		HasPassword:     user.Password != "",
+		HasProfilePIN:   user.ProfilePIN != "",
+		Identities:      identities,
+		CreatedAt:       user.CreatedAt,
+	}
+}
+
+// UpdateMe changes the names and favourite genres, fields left out of the body are kept.
+// Recommendations come from the profile, so the genres are copied to the default one.
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FirstName       *string        `json:"first_name" validate:"omitempty,min=2,max=20"`
+		LastName        *string        `json:"last_name" validate:"omitempty,min=2,max=20"`
+		FavouriteGenres []models.Genre `json:"favourite_genres" validate:"omitempty,dive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: time.Now()}}
+	if req.FirstName != nil {
+		set = append(set, bson.E{Key: "first_name", Value: *req.FirstName})
+	}
+	if req.LastName != nil {
+		set = append(set, bson.E{Key: "last_name", Value: *req.LastName})
+	}
+	if req.FavouriteGenres != nil {
+		if err := validateGenres(r.Context(), req.FavouriteGenres); err != nil {
+			if errors.Is(err, errUnknownGenre) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to check genres"})
+			return
+		}
+		set = append(set, bson.E{Key: "favourite_genres", Value: req.FavouriteGenres})
+	}
+
+	_, err = userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update account"})
+		return
+	}
+
+	if req.FavouriteGenres != nil {
+		// creating the default profile here picks up the new genres already
+		profile, err := utils.DefaultProfile(r.Context(), userId)
+		if err == nil {
+			_, err = profileCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "profile_id", Value: profile.ProfileID}}, bson.D{
+				bson.E{Key: "$set", Value: bson.D{
+					bson.E{Key: "favourite_genres", Value: req.FavouriteGenres},
+					bson.E{Key: "updated_at", Value: time.Now()},
+				}},
+			})
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to update profile"})
+			return
+		}
+	}
+
+	GetMe(w, r)
+}
+
+// ChangePassword needs the current password, accounts without one need a recent login.
+// Every other session is signed out, this one gets fresh tokens.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "new password required"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Password == "" {
+		// accounts created through an identity provider have no password yet. A first
+		// password is a new permanent way in, a stolen access token alone mustn't be able
+		// to add one: it takes a fresh provider or 2fa login, or the reset email.
+		method, recent := utils.RecentLogin(r.Context(), passwordReauthMaxAge)
+		mfaSession, _ := r.Context().Value(utils.MFA).(bool)
+		if !recent || (method != utils.LoginMethodOIDC && !mfaSession) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error":                     "sign in again or use the password reset email to set a password",
+				"reauthentication_required": true,
+			})
+			return
+		}
+	} else if !checkCurrentPassword(w, r, user, req.CurrentPassword) {
+		return
+	}
+
+	if problems := utils.DefaultPasswordPolicy.Check(req.NewPassword, user.Email, user.FirstName, user.LastName); len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password does not meet the password policy", "details": problems})
+		return
+	}
+
+	hashedPwd, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password not stored"})
+		return
+	}
+
+	_, err = userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "password", Value: hashedPwd},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password not stored"})
+		return
+	}
+
+	if err := utils.RevokeUserSessions(r.Context(), user.UserID); err != nil {
+		log.Printf("failed to revoke sessions for %s: %v", user.UserID, err)
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "password.changed",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	err = mailer.Default.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"The password of your account was just changed and all other devices were signed out.\n\n" +
+			"If this wasn't you, reset your password right away.\n",
+	})
+	if err != nil {
+		log.Printf("failed to send password change notice to %s: %v", user.UserID, err)
+	}
+
+	// the session that made the change keeps working
+	mfa, _ := r.Context().Value(utils.MFA).(bool)
+	profileId, _ := r.Context().Value(utils.ProfileID).(string)
+	token, refreshToken, ok := startSession(w, r, user, utils.WithMFA(mfa), utils.WithProfile(profileId), utils.KeepLogin(r.Context()))
+	if !ok {
+		return
+	}
+	resp := map[string]any{"successful": true}
+	if isNonBrowserClient(r) {
+		resp["token"] = token
+		resp["refresh_token"] = refreshToken
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DeleteMe schedules the account for deletion after ACCOUNT_DELETION_GRACE and signs
+// out everywhere. Signing in again before then cancels it.
+func DeleteMe(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Password != "" && !checkCurrentPassword(w, r, user, req.Password) {
+		return
+	}
+
+	deleteAt := time.Now().Add(accountDeletionGrace)
+	_, err := userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "deletion_scheduled_at", Value: deleteAt},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to schedule deletion"})
+		return
+	}
+
+	if err := utils.RevokeUserSessions(r.Context(), user.UserID); err != nil {
+		log.Printf("failed to revoke sessions for %s: %v", user.UserID, err)
+	}
+	clearSessionCookies(w)
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "account.deletion_scheduled",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		Details:    map[string]any{"delete_at": deleteAt},
+		IP:         utils.ClientIP(r),
+	})
+
+	err = mailer.Default.Send(r.Context(), mailer.Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"Your account and its data will be deleted on " + deleteAt.Format("2 January 2006") + ".\n\n" +
+			"Changed your mind? Just sign in again before then and the deletion is cancelled.\n",
+	})
+	if err != nil {
+		log.Printf("failed to send deletion notice to %s: %v", user.UserID, err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"successful": true, "deletion_scheduled_at": deleteAt})
+}
+
+// checkCurrentPassword confirms a change with the user's password. Wrong passwords
+// count towards the same throttling and lockout as failed logins.
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, user models.User, password string) bool {
+	if loginThrottled(w, r, user.Email) {
+		return false
+	}
+	match, _, err := utils.VerifyPassword(user.Password, password)
+	if err != nil {
+		log.Printf("failed to verify password for %s: %v", user.UserID, err)
+	}
+	if !match {
+		recordLoginFailure(r, user.Email)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password is incorrect"})
+		return false
+	}
+	return true
+}
+
+// requireReauth guards adding a new way into the account. A stolen access token alone
+// mustn't be enough: it takes a recent login plus the current password or a 2fa
+// session. Accounts without a password can use a fresh provider login instead.
+func requireReauth(w http.ResponseWriter, r *http.Request, user models.User, password string) bool {
+	method, recent := utils.RecentLogin(r.Context(), passwordReauthMaxAge)
+	mfaSession, _ := r.Context().Value(utils.MFA).(bool)
+	switch {
+	case !recent:
+	case mfaSession:
+		return true
+	case user.Password != "":
+		return checkCurrentPassword(w, r, user, password)
+	case method == utils.LoginMethodOIDC:
+		return true
+	}
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":                     "sign in again to continue",
+		"reauthentication_required": true,
+	})
+	return false
+}
+
+func cancelAccountDeletion(r *http.Request, user models.User) {
+	_, err := userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "deletion_scheduled_at", Value: ""}}},
+	})
+	if err != nil {
+		log.Printf("failed to cancel deletion of %s: %v", user.UserID, err)
+		return
+	}
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "account.deletion_cancelled",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+}
+
+// RunAccountPurger erases accounts whose grace period is over, every
+// ACCOUNT_PURGE_INTERVAL until ctx is done.
+func RunAccountPurger(ctx context.Context) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := purgeDeletedAccounts(ctx); err != nil {
+			log.Printf("account purge failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedAccounts hands accounts whose grace period is over to the erasure
+// pipeline. A failed erasure is queued again on the next run.
+func purgeDeletedAccounts(ctx context.Context) error {
+	cursor, err := userCollection.Find(ctx, bson.D{
+		bson.E{Key: "deletion_scheduled_at", Value: bson.D{bson.E{Key: "$lte", Value: time.Now()}}},
+	})
+	if err != nil {
+		return err
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if _, err := privacy.Enqueue(ctx, models.PrivacyJobErasure, user.UserID, privacy.SystemActor); err != nil {
+			log.Printf("failed to queue erasure of %s: %v", user.UserID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// how long an impersonation token is good for, it can't be refreshed
+var impersonationTTL = utils.GetEnvDuration("IMPERSONATION_TTL", 15*time.Minute)
+
+// pagination reads ?page= (from 1) and ?per_page=, falling back to the defaults on bad input.
+func pagination(r *http.Request) (page, perPage int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPageSize
+	}
+	return page, min(perPage, maxPageSize)
+}
+
+func adminUserResponse(user models.User) models.AdminUserResponse {
+	return models.AdminUserResponse{
+		AccountResponse:     accountResponse(user),
+		Status:              user.Status,
+		DisabledAt:          user.DisabledAt,
+		DisabledReason:      user.DisabledReason,
+		DeletionScheduledAt: user.DeletionScheduledAt,
+		UpdatedAt:           user.UpdatedAt,
+	}
+}
+
+// SearchUsers lists users, ?q= matches the start of the email, first or last name.
+func SearchUsers(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+
+	filter := bson.D{}
+	if q := r.URL.Query().Get("q"); q != "" {
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q), Options: "i"}
+		filter = bson.D{bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "email", Value: pattern}},
+			bson.D{bson.E{Key: "first_name", Value: pattern}},
+			bson.D{bson.E{Key: "last_name", Value: pattern}},
+		}}}
+	}
+
+	total, err := userCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search users"})
+		return
+	}
+
+	cursor, err := userCollection.Find(r.Context(), filter, options.Find().
+		SetSort(bson.D{bson.E{Key: "email", Value: 1}}).
+		SetSkip(int64((page-1)*perPage)).
+		SetLimit(int64(perPage)))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search users"})
+		return
+	}
+	var users []models.User
+	if err := cursor.All(r.Context(), &users); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search users"})
+		return
+	}
+
+	results := []models.AdminUserResponse{}
+	for _, user := range users {
+		results = append(results, adminUserResponse(user))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"users": results, "page": page, "per_page": perPage, "total": total})
+}
+
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	var user models.User
+	err := userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: r.PathValue("user_id")}}).Decode(&user)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(adminUserResponse(user))
+}
+
+// SetUserRoles replaces the user's roles and signs them out, tokens carry the roles
+// they were issued with. Added roles can only carry permissions the admin holds.
+func SetUserRoles(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Roles []string `json:"roles" validate:"required,min=1,dive,required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "at least one role required"})
+		return
+	}
+	slices.Sort(req.Roles)
+	req.Roles = slices.Compact(req.Roles)
+
+	roles, err := utils.AllRoles(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load roles"})
+		return
+	}
+	for _, name := range req.Roles {
+		if _, ok := roles[name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown role " + name})
+			return
+		}
+	}
+
+	adminId, _ := utils.GetDataFromContext(r)
+	userId := r.PathValue("user_id")
+	// an admin taking away their own access could leave nobody able to undo it
+	if userId == adminId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot change your own roles"})
+		return
+	}
+
+	var before models.User
+	err = userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}).Decode(&before)
+	if !userUpdated(w, err) {
+		return
+	}
+	// the roles the user gains can't carry permissions the admin doesn't hold
+	granted := []string{}
+	for _, name := range req.Roles {
+		if !slices.Contains(before.Roles, name) {
+			granted = append(granted, roles[name].Permissions...)
+		}
+	}
+	if !canGrant(w, r, granted) {
+		return
+	}
+
+	// matching the roles that were checked, a concurrent change makes this one fail
+	result, err := userCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "roles", Value: before.Roles},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "roles", Value: req.Roles},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update user"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "roles were changed meanwhile, try again"})
+		return
+	}
+
+	previous := slices.Clone(before.Roles)
+	slices.Sort(previous)
+	if !slices.Equal(previous, req.Roles) {
+		if err := utils.RevokeUserSessions(r.Context(), userId); err != nil {
+			log.Printf("failed to revoke sessions for %s: %v", userId, err)
+		}
+		utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+			ActorID:    adminId,
+			Action:     "user.roles_changed",
+			TargetType: "user",
+			TargetID:   userId,
+			Before:     map[string]any{"roles": before.Roles},
+			After:      map[string]any{"roles": req.Roles},
+			IP:         utils.ClientIP(r),
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// DisableUser blocks sign-in and refresh and signs the user out everywhere.
+func DisableUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// the reason is optional, an empty body is fine
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+			return
+		}
+	}
+
+	adminId, _ := utils.GetDataFromContext(r)
+	userId := r.PathValue("user_id")
+	if userId == adminId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot disable your own account"})
+		return
+	}
+
+	now := time.Now()
+	var before models.User
+	err := userCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "disabled_at", Value: now},
+			bson.E{Key: "disabled_reason", Value: req.Reason},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	}).Decode(&before)
+	if !userUpdated(w, err) {
+		return
+	}
+
+	if err := utils.RevokeUserSessions(r.Context(), userId); err != nil {
+		log.Printf("failed to revoke sessions for %s: %v", userId, err)
+	}
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "user.disabled",
+		TargetType: "user",
+		TargetID:   userId,
+		Before:     map[string]any{"disabled": before.DisabledAt != nil, "reason": before.DisabledReason},
+		After:      map[string]any{"disabled": true, "reason": req.Reason},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+func EnableUser(w http.ResponseWriter, r *http.Request) {
+	adminId, _ := utils.GetDataFromContext(r)
+	userId := r.PathValue("user_id")
+
+	var before models.User
+	err := userCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}, bson.D{
+		bson.E{Key: "$unset", Value: bson.D{
+			bson.E{Key: "disabled_at", Value: ""},
+			bson.E{Key: "disabled_reason", Value: ""},
+		}},
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: time.Now()}}},
+	}).Decode(&before)
+	if !userUpdated(w, err) {
+		return
+	}
+	utils.InvalidateSessionCache(userId)
+
+	if before.DisabledAt != nil {
+		utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+			ActorID:    adminId,
+			Action:     "user.enabled",
+			TargetType: "user",
+			TargetID:   userId,
+			Before:     map[string]any{"disabled": true, "reason": before.DisabledReason},
+			After:      map[string]any{"disabled": false},
+			IP:         utils.ClientIP(r),
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// ForceLogoutUser ends every session of the user. Tokens stop working right away on
+// this instance and within SESSION_CACHE_TTL on the others.
+func ForceLogoutUser(w http.ResponseWriter, r *http.Request) {
+	adminId, _ := utils.GetDataFromContext(r)
+	userId := r.PathValue("user_id")
+
+	count, err := userCollection.CountDocuments(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load user"})
+		return
+	}
+	if count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	if err := utils.RevokeUserSessions(r.Context(), userId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to revoke sessions"})
+		return
+	}
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "user.sessions_revoked",
+		TargetType: "user",
+		TargetID:   userId,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// ImpersonateUser issues a short lived access token for the user that also names the
+// admin behind it. The token is only returned in the body so the admin's own session
+// cookies stay as they are. Impersonated sessions hold no permissions and can't touch
+// credentials, see custommiddleware.RejectImpersonation.
+func ImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason" validate:"required,max=500"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a reason is required"})
+		return
+	}
+
+	adminId, _ := utils.GetDataFromContext(r)
+	userId := r.PathValue("user_id")
+	if userId == adminId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot impersonate yourself"})
+		return
+	}
+
+	var user models.User
+	err := userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load user"})
+		return
+	}
+	if user.DisabledAt != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Account has been disabled"})
+		return
+	}
+	// staff accounts are off limits, impersonating them would only be useful for
+	// reading other admins' data
+	permissions, err := utils.ResolvePermissions(r.Context(), user.Roles)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load permissions"})
+		return
+	}
+	if len(permissions) > 0 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot impersonate a privileged account"})
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationTTL)
+	token, err := utils.GenerateImpersonationToken(user, adminId, impersonationTTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue token"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "user.impersonation_started",
+		TargetType: "user",
+		TargetID:   userId,
+		Details:    map[string]any{"reason": req.Reason, "expires_at": expiresAt},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "user_id": userId, "expires_at": expiresAt})
+}
+
+// userUpdated writes the error response for a failed FindOneAndUpdate on a user.
+func userUpdated(w http.ResponseWriter, err error) bool {
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update user"})
+		return false
+	}
+	return true
+}
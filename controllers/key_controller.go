@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// GetJWKS publishes the public keys so other services can verify our tokens on their own.
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(utils.Keys.JWKS())
+}
+
+// RotateSigningKey makes a new key active. Tokens signed with the old key keep
+// validating for utils.KeyRetention, the old key stays in the set until then.
+func RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	previous := utils.Keys.Active().ID
+	key, err := utils.Keys.Rotate()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to rotate signing key"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	log.Printf("signing key rotated to %s by %s", key.ID, userId)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "keys.rotated",
+		TargetType: "signing_key",
+		TargetID:   key.ID,
+		Before:     map[string]any{"active_kid": previous},
+		After:      map[string]any{"active_kid": key.ID, "alg": key.Method.Alg()},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"kid": key.ID, "alg": key.Method.Alg()})
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/mailer"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var magicLinkCollection *mongo.Collection = database.OpenCollection("magic_links")
+
+var (
+	magicLinkTTL = utils.GetEnvDuration("MAGIC_LINK_TTL", 15*time.Minute)
+	// at most MAGIC_LINK_MAX_PER_WINDOW links per email every MAGIC_LINK_RATE_WINDOW (up to a day)
+	magicLinkMaxPerWindow = utils.GetEnvInt("MAGIC_LINK_MAX_PER_WINDOW", 3)
+	magicLinkRateWindow   = utils.GetEnvDuration("MAGIC_LINK_RATE_WINDOW", time.Hour)
+	magicLinkCallbackURL  = utils.GetEnvString("MAGIC_LINK_CALLBACK_URL", "http://localhost:8080/api/login/magic/callback")
+	// where the browser lands after the callback, signed in or asked for the 2fa code
+	magicLinkRedirectURL = utils.GetEnvString("MAGIC_LINK_REDIRECT", "http://localhost:3000/")
+)
+
+// the link only works in the browser that asked for it, a forwarded or intercepted
+// email is not enough to sign in
+const magicLinkBindingCookie = "magic_link_binding"
+
+// RequestMagicLink emails a sign-in link. Like ForgotPassword the response doesn't
+// depend on whether the email is registered or rate limited.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+
+	binding, bindingHash, err := utils.NewOpaqueToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to send sign-in link"})
+		return
+	}
+	utils.SetCookie(w, magicLinkBindingCookie, binding, int(magicLinkTTL.Seconds()), true)
+
+	go func(email string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := sendMagicLink(ctx, email, bindingHash); err != nil {
+			log.Printf("failed to send magic link: %v", err)
+		}
+	}(req.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the address is registered a sign-in link has been sent"})
+}
+
+func sendMagicLink(ctx context.Context, email, bindingHash string) error {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "email", Value: email}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed, err := utils.AllowEmail(ctx, utils.EmailKindMagicLink, user.Email, magicLinkMaxPerWindow, magicLinkRateWindow)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("magic link for %s not sent, rate limit reached", user.UserID)
+		return nil
+	}
+
+	token, err := utils.GeneratePurposeToken(utils.MagicLinkTokenType, user.UserID, user.Email, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	// earlier links keep working until one of them is used, anyone can ask for a link so
+	// asking mustn't cancel the ones the user already has
+	now := time.Now()
+	_, err = magicLinkCollection.InsertOne(ctx, models.MagicLink{
+		TokenHash:   utils.HashOpaqueToken(token),
+		BindingHash: bindingHash,
+		UserID:      user.UserID,
+		Email:       user.Email,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := magicLinkCallbackURL + "?token=" + url.QueryEscape(token)
+	return mailer.Default.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your sign-in link",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"Open the link below in the same browser you asked for it from to sign in. It works once and expires in " + magicLinkTTL.String() + ".\n\n" +
+			link + "\n\n" +
+			"If you didn't ask to sign in, you can ignore this email.\n",
+	})
+}
+
+// MagicLinkCallback is opened from the email. It signs the browser in with the same
+// cookies as LoginUser and redirects to the frontend.
+func MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	claims, err := utils.ValidatePurposeToken(token, utils.MagicLinkTokenType)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired sign-in link"})
+		return
+	}
+
+	binding, err := r.Cookie(magicLinkBindingCookie)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "open the sign-in link in the browser you requested it from"})
+		return
+	}
+
+	// binding, expiry and single use are all checked in the update so concurrent clicks can't both sign in
+	now := time.Now()
+	result, err := magicLinkCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "token_hash", Value: utils.HashOpaqueToken(token)},
+		bson.E{Key: "binding_hash", Value: utils.HashOpaqueToken(binding.Value)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to sign in"})
+		return
+	}
+	if result.ModifiedCount == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired sign-in link"})
+		return
+	}
+	utils.SetCookie(w, magicLinkBindingCookie, "", -1, true)
+
+	// signing in uses up every other link the user still has
+	if _, err := magicLinkCollection.UpdateMany(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: claims.UserId},
+		bson.E{Key: "used_at", Value: nil},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}},
+	}); err != nil {
+		log.Printf("failed to invalidate magic links of %s: %v", claims.UserId, err)
+	}
+
+	// the email must still be the one the link went to
+	var user models.User
+	err = userCollection.FindOne(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: claims.UserId},
+		bson.E{Key: "email", Value: claims.Email},
+	}).Decode(&user)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired sign-in link"})
+		return
+	}
+
+	// getting the link proves the address is theirs
+	if !user.IsEmailVerified() {
+		_, err := userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+			bson.E{Key: "$set", Value: bson.D{
+				bson.E{Key: "status", Value: models.UserStatusActive},
+				bson.E{Key: "email_verified_at", Value: now},
+				bson.E{Key: "updated_at", Value: now},
+			}},
+		})
+		if err != nil {
+			log.Printf("failed to verify email of %s: %v", user.UserID, err)
+		} else {
+			user.Status = models.UserStatusActive
+			user.EmailVerifiedAt = &now
+		}
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "magic_link.login",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	// the link replaces the password, the second factor is still asked for
+	if user.TOTPEnabled {
+		redirectToMFA(w, r, user, magicLinkRedirectURL)
+		return
+	}
+
+	if _, _, ok := startSession(w, r, user, utils.WithLogin(utils.LoginMethodMagicLink)); !ok {
+		return
+	}
+	http.Redirect(w, r, magicLinkRedirectURL, http.StatusFound)
+}
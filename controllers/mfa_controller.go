@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	mfaChallengeTTL   = utils.GetEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+	recoveryCodeCount = utils.GetEnvInt("MFA_RECOVERY_CODES", 10)
+)
+
+// EnrollTOTP starts enrollment. The secret stays pending until ConfirmTOTP proves the
+// authenticator app produces valid codes.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate secret"})
+		return
+	}
+
+	_, err = userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "totp_pending_secret", Value: secret}}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start enrollment"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": utils.TOTPURI(user.Email, secret),
+	})
+}
+
+// ConfirmTOTP turns 2fa on and returns the recovery codes, this is the only time they are shown.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	step, valid := utils.ValidateTOTP(user.TOTPPendingSecret, req.Code, time.Now())
+	if user.TOTPPendingSecret == "" || !valid {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		return
+	}
+
+	codes, hashes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate recovery codes"})
+		return
+	}
+
+	_, err = userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "totp_enabled", Value: true},
+			bson.E{Key: "totp_secret", Value: user.TOTPPendingSecret},
+			bson.E{Key: "totp_last_step", Value: step},
+			bson.E{Key: "recovery_codes", Value: hashes},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "totp_pending_secret", Value: ""}}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to enable two-factor authentication"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "mfa.enabled",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"enabled": true, "recovery_codes": codes})
+}
+
+// DisableTOTP needs a current code, a stolen session alone can't switch 2fa off.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	if !useTOTPCode(r, user, req.Code) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		return
+	}
+
+	_, err := userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "totp_enabled", Value: false},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+		bson.E{Key: "$unset", Value: bson.D{
+			bson.E{Key: "totp_secret", Value: ""},
+			bson.E{Key: "totp_last_step", Value: ""},
+			bson.E{Key: "recovery_codes", Value: ""},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to disable two-factor authentication"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "mfa.disabled",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": false})
+}
+
+// LoginWithTOTP is the second step of LoginUser for accounts with 2fa on. It takes the
+// mfa_token from the first step plus either a totp code or one of the recovery codes.
+func LoginWithTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		ReturnTokens bool   `json:"return_tokens"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	claims, err := utils.ValidatePurposeToken(req.MFAToken, utils.MFAChallengeTokenType)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired login challenge"})
+		return
+	}
+
+	// codes are only 6 digits, they go through the same throttling as passwords
+	if loginThrottled(w, r, claims.Email) {
+		return
+	}
+
+	var user models.User
+	if err := userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: claims.UserId}}).Decode(&user); err != nil || !user.TOTPEnabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired login challenge"})
+		return
+	}
+
+	valid := false
+	if req.RecoveryCode != "" {
+		valid = useRecoveryCode(r, user, req.RecoveryCode)
+	} else {
+		valid = useTOTPCode(r, user, req.Code)
+	}
+
+	if !valid {
+		loginFailed(w, r, user.Email)
+		return
+	}
+
+	completeLogin(w, r, user, req.ReturnTokens, utils.WithMFA(true), utils.WithLogin(utils.LoginMethodTOTP))
+}
+
+// useTOTPCode validates the code and records its time step, the conditional update
+// makes sure the same code can't be used twice, even by two requests racing.
+func useTOTPCode(r *http.Request, user models.User, code string) bool {
+	step, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+	result, err := userCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: user.UserID},
+		bson.E{Key: "totp_last_step", Value: bson.D{bson.E{Key: "$lt", Value: step}}},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "totp_last_step", Value: step}}},
+	})
+	return err == nil && result.ModifiedCount == 1
+}
+
+func useRecoveryCode(r *http.Request, user models.User, code string) bool {
+	hash := utils.HashRecoveryCode(code)
+	result, err := userCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: user.UserID},
+		bson.E{Key: "recovery_codes", Value: hash},
+	}, bson.D{
+		bson.E{Key: "$pull", Value: bson.D{bson.E{Key: "recovery_codes", Value: hash}}},
+	})
+	if err != nil || result.ModifiedCount != 1 {
+		return false
+	}
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "mfa.recovery_code_used",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+	return true
+}
+
+// currentUser loads the authenticated user, writing the error response itself if it can't.
+func currentUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var user models.User
+
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return user, false
+	}
+
+	if err := userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}}).Decode(&user); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return user, false
+	}
+
+	return user, true
+}
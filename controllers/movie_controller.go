@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,15 +23,134 @@ import (
 
 var movieCollection *mongo.Collection = database.OpenCollection("movies")
 var rankingCollection *mongo.Collection = database.OpenCollection("rankings")
+var genreCollection *mongo.Collection = database.OpenCollection("genres")
 var validate = validator.New()
 
+// catalogFilter narrows filter down to the movies the profile may see: rated at or below
+// its maturity level and not blocked for it. Every catalog read has to go through it.
+func catalogFilter(profile models.Profile, filter bson.D) bson.D {
+	// adults see unrated movies too, a missing age level never matches $lte
+	if profile.MaturityLevel < models.MaturityAdult {
+		filter = append(filter, bson.E{Key: "maturity.age_level", Value: bson.D{bson.E{Key: "$lte", Value: profile.MaturityLevel}}})
+	}
+	if len(profile.BlockedTitles) > 0 {
+		filter = append(filter, bson.E{Key: "imdb_id", Value: bson.D{bson.E{Key: "$nin", Value: profile.BlockedTitles}}})
+	}
+	return filter
+}
+
+// movieSorts are the ?sort= values GetMovies accepts, prefixed with - for descending.
+var movieSorts = map[string]string{
+	"release_date": "release_date",
+	"runtime":      "runtime_minutes",
+	"title":        "title",
+}
+
+// movieListFilter reads the metadata filters and the sort order of GetMovies:
+// ?release_year_from=, ?release_year_to=, ?runtime_min=, ?runtime_max=, ?language=,
+// ?original_language=, ?country= and ?sort=.
+func movieListFilter(r *http.Request, filter bson.D) (bson.D, *options.FindOptions, error) {
+	query := r.URL.Query()
+	findOptions := options.Find()
+
+	intParam := func(name string) (int, bool, error) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("invalid %s", name)
+		}
+		return n, true, nil
+	}
+
+	release := bson.D{}
+	from, ok, err := intParam("release_year_from")
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		release = append(release, bson.E{Key: "$gte", Value: time.Date(from, time.January, 1, 0, 0, 0, 0, time.UTC)})
+	}
+	to, ok, err := intParam("release_year_to")
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		release = append(release, bson.E{Key: "$lt", Value: time.Date(to+1, time.January, 1, 0, 0, 0, 0, time.UTC)})
+	}
+	if len(release) > 0 {
+		filter = append(filter, bson.E{Key: "release_date", Value: release})
+	}
+
+	runtime := bson.D{}
+	runtimeMin, ok, err := intParam("runtime_min")
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		runtime = append(runtime, bson.E{Key: "$gte", Value: runtimeMin})
+	}
+	runtimeMax, ok, err := intParam("runtime_max")
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		runtime = append(runtime, bson.E{Key: "$lte", Value: runtimeMax})
+	}
+	if len(runtime) > 0 {
+		// an unknown runtime is unset and never matches
+		filter = append(filter, bson.E{Key: "runtime_minutes", Value: runtime})
+	}
+
+	if language := query.Get("language"); language != "" {
+		filter = append(filter, bson.E{Key: "spoken_languages", Value: strings.ToLower(language)})
+	}
+	if language := query.Get("original_language"); language != "" {
+		filter = append(filter, bson.E{Key: "original_language", Value: strings.ToLower(language)})
+	}
+	if country := query.Get("country"); country != "" {
+		filter = append(filter, bson.E{Key: "production_countries", Value: strings.ToUpper(country)})
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		order := 1
+		if strings.HasPrefix(sort, "-") {
+			order = -1
+			sort = sort[1:]
+		}
+		field, ok := movieSorts[sort]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid sort %s", sort)
+		}
+		// imdb_id keeps movies with equal values in a stable order
+		findOptions.SetSort(bson.D{bson.E{Key: field, Value: order}, bson.E{Key: "imdb_id", Value: 1}})
+	}
+
+	return filter, findOptions, nil
+}
+
+// GetMovies lists the movies the active profile may see, ?person_id= and ?role= narrow
+// it down to a person's movies, see movieListFilter for the metadata filters.
 func GetMovies(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30) // Use this in middleware layer
-	defer cancel()
+	ctx := r.Context()
+
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+
+	filter, findOptions, err := movieListFilter(r, personFilter(r, bson.D{}))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
 	var movies []models.Movie
 
-	curr, err := movieCollection.Find(ctx, bson.D{})
+	curr, err := movieCollection.Find(ctx, catalogFilter(profile, filter), findOptions)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -49,8 +170,7 @@ func GetMovies(w http.ResponseWriter, r *http.Request) {
 }
 
 func AddMovie(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	defer cancel()
+	ctx := r.Context()
 
 	var movie models.Movie
 
@@ -60,6 +180,8 @@ func AddMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	utils.NormalizeMovieMetadata(&movie.MovieMetadata)
+
 	// relevant validation code
 	if err := validate.Struct(movie); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -67,6 +189,30 @@ func AddMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if movie.Maturity != nil {
+		if err := utils.NormalizeMaturity(movie.Maturity); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	if !validCredits(w, r, movie.Credits) {
+		return
+	}
+
+	// movies and series share the imdb id space
+	count, err := seriesCollection.CountDocuments(ctx, bson.D{bson.E{Key: "imdb_id", Value: movie.ImdbID}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while inserting movie"})
+		return
+	}
+	if count > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a title with this imdb id already exists"})
+		return
+	}
+
 	result, err := movieCollection.InsertOne(ctx, &movie)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -74,6 +220,16 @@ func AddMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(ctx, models.AuditEvent{
+		ActorID:    userId,
+		Action:     "movie.created",
+		TargetType: "movie",
+		TargetID:   movie.ImdbID,
+		After:      movieAuditState(movie),
+		IP:         utils.ClientIP(r),
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(201)
 	json.NewEncoder(w).Encode(result)
@@ -104,7 +260,7 @@ func AdminReviewUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sentiment, rankVal, err := GetReviewRanking(req.AdminReview)
+	sentiment, rankVal, err := GetReviewRanking(r.Context(), req.AdminReview)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -138,10 +294,15 @@ func AdminReviewUpdate(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
+	// the document as it was before the update is what the audit log needs
+	var before models.Movie
+	err = movieCollection.FindOneAndUpdate(r.Context(), filter, update).Decode(&before)
 
-	result, err := movieCollection.UpdateOne(ctx, filter, update)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "resource not found/updated"})
+		return
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -149,11 +310,16 @@ func AdminReviewUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "resource not found/updated"})
-		return
-	}
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "movie.review_updated",
+		TargetType: "movie",
+		TargetID:   movieId,
+		Before:     map[string]any{"admin_review": before.AdminReview, "ranking_name": before.Ranking.RankingName, "ranking_value": before.Ranking.RankingValue},
+		After:      map[string]any{"admin_review": req.AdminReview, "ranking_name": sentiment, "ranking_value": rankVal},
+		IP:         utils.ClientIP(r),
+	})
 
 	resp.RankingName = sentiment
 	resp.AdminReview = req.AdminReview
@@ -163,8 +329,8 @@ func AdminReviewUpdate(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func GetReviewRanking(admin_review string) (string, int, error) {
-	rankings, err := GetRankings()
+func GetReviewRanking(ctx context.Context, admin_review string) (string, int, error) {
+	rankings, err := GetRankings(ctx)
 	if err != nil {
 		return "", 0, err
 	}
@@ -194,7 +360,7 @@ func GetReviewRanking(admin_review string) (string, int, error) {
 
 	base_prompt := strings.Replace(base_prompt_template, "{rankings}", sentimentDelimited, 1)
 
-	response, err := llm.Call(context.Background(), base_prompt+admin_review)
+	response, err := llm.Call(ctx, base_prompt+admin_review)
 	if err != nil {
 		return "", 0, err
 	}
@@ -210,12 +376,9 @@ func GetReviewRanking(admin_review string) (string, int, error) {
 	return response, rankVal, nil
 }
 
-func GetRankings() ([]models.Ranking, error) {
+func GetRankings(ctx context.Context) ([]models.Ranking, error) {
 	var rankings []models.Ranking
 
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
 	cursor, err := rankingCollection.Find(ctx, bson.D{})
 
 	if err != nil {
@@ -231,30 +394,25 @@ func GetRankings() ([]models.Ranking, error) {
 	return rankings, nil
 }
 
+// GetRecommendedMovies picks from the favourite genres of the active profile.
 func GetRecommendedMovies(w http.ResponseWriter, r *http.Request) {
-	userId, err := utils.GetDataFromContext(r)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+	profile, ok := activeProfile(w, r)
+	if !ok {
 		return
 	}
 
-	favourite_genres, err := GetUserFavouriteGenres(string(userId))
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "error is " + err.Error()})
-		return
+	favourite_genres := []string{}
+	for _, genre := range profile.FavouriteGenres {
+		favourite_genres = append(favourite_genres, genre.GenreName)
 	}
 
 	findOptions := options.Find()
 	findOptions.SetLimit(5)
-	filter := bson.M{"genre.genre_name": bson.M{"$in": favourite_genres}}
-
-	var ctx, cancel = context.WithTimeout(r.Context(), 100*time.Second)
+	filter := catalogFilter(profile, bson.D{
+		bson.E{Key: "genres.genre_name", Value: bson.D{bson.E{Key: "$in", Value: favourite_genres}}},
+	})
 
-	defer cancel()
+	ctx := r.Context()
 
 	cursor, err := movieCollection.Find(ctx, filter, findOptions)
 
@@ -278,57 +436,175 @@ func GetRecommendedMovies(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&recommendedMovies)
 }
 
-func GetUserFavouriteGenres(userId string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
+// SetMovieMaturity sets or replaces the maturity rating of a movie.
+func SetMovieMaturity(w http.ResponseWriter, r *http.Request) {
+	var rating models.MaturityRating
+	if err := json.NewDecoder(r.Body).Decode(&rating); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(rating); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "system and rating are required"})
+		return
+	}
+	if err := utils.NormalizeMaturity(&rating); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-	filter := bson.D{
-		bson.E{
-			Key:   "user_id",
-			Value: userId,
-		},
+	movieId := r.PathValue("imdb_id")
+	var before models.Movie
+	err := movieCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: movieId}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "maturity", Value: rating}}},
+	}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Movie not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error updating movie"})
+		return
 	}
 
-	projection := bson.D{
-		bson.E{
-			Key:   "favourite_genre.genre_name",
-			Value: 1,
-		},
-		bson.E{
-			Key:   "_id",
-			Value: 0,
-		},
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "movie.maturity_updated",
+		TargetType: "movie",
+		TargetID:   movieId,
+		Before:     map[string]any{"maturity": before.Maturity},
+		After:      map[string]any{"maturity": rating},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&rating)
+}
+
+// UpdateMovieMetadata changes the metadata of a movie, fields left out of the body keep
+// their value.
+func UpdateMovieMetadata(w http.ResponseWriter, r *http.Request) {
+	movieId := r.PathValue("imdb_id")
+
+	var movie models.Movie
+	err := movieCollection.FindOne(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: movieId}}).Decode(&movie)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Movie not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error fetching movie"})
+		return
 	}
 
-	opts := options.FindOne().SetProjection(projection)
-	var result bson.M
-	err := userCollection.FindOne(ctx, filter, opts).Decode(&result)
+	// decoding over the stored metadata only replaces the fields in the body
+	before := movie.MovieMetadata
+	metadata := movie.MovieMetadata
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	utils.NormalizeMovieMetadata(&metadata)
+	if err := validate.Struct(metadata); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while validating body" + err.Error()})
+		return
+	}
+
+	update := bson.D{bson.E{Key: "$set", Value: metadata}}
+	// release date and runtime are omitempty, clearing them needs an $unset
+	unset := bson.D{}
+	if metadata.ReleaseDate == nil {
+		unset = append(unset, bson.E{Key: "release_date", Value: ""})
+	}
+	if metadata.RuntimeMinutes == 0 {
+		unset = append(unset, bson.E{Key: "runtime_minutes", Value: ""})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unset})
+	}
 
+	result, err := movieCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: movieId}}, update)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return []string{}, nil
-		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error updating movie"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Movie not found"})
+		return
 	}
 
-	favGenresArray, ok := result["favourite_genres"].(bson.A)
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "movie.metadata_updated",
+		TargetType: "movie",
+		TargetID:   movieId,
+		Before:     movieMetadataAuditState(before),
+		After:      movieMetadataAuditState(metadata),
+		IP:         utils.ClientIP(r),
+	})
 
-	if !ok {
-		return []string{}, errors.New("unable to retrive favourite genres for user")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&metadata)
+}
+
+func movieMetadataAuditState(metadata models.MovieMetadata) map[string]any {
+	return map[string]any{
+		"release_date":         metadata.ReleaseDate,
+		"runtime_minutes":      metadata.RuntimeMinutes,
+		"original_language":    metadata.OriginalLanguage,
+		"spoken_languages":     metadata.SpokenLanguages,
+		"production_countries": metadata.ProductionCountries,
+		"tagline":              metadata.Tagline,
+		"synopsis":             metadata.Synopsis,
+		"backdrops":            metadata.Backdrops,
 	}
+}
 
-	var genreNames []string
+func movieAuditState(movie models.Movie) map[string]any {
+	genres := []string{}
+	for _, genre := range movie.Genre {
+		genres = append(genres, genre.GenreName)
+	}
+	return map[string]any{
+		"title":         movie.Title,
+		"poster_path":   movie.PosterPath,
+		"youtube_id":    movie.YoutubeID,
+		"genres":        genres,
+		"admin_review":  movie.AdminReview,
+		"ranking_name":  movie.Ranking.RankingName,
+		"ranking_value": movie.Ranking.RankingValue,
+		"maturity":      movie.Maturity,
+		"metadata":      movieMetadataAuditState(movie.MovieMetadata),
+	}
+}
 
-	for _, item := range favGenresArray {
-		if genreMap, ok := item.(bson.D); ok {
-			for _, elem := range genreMap {
-				if elem.Key == "genre" {
-					if name, ok := elem.Value.(string); ok {
-						genreNames = append(genreNames, name)
-					}
-				}
-			}
+var errUnknownGenre = errors.New("unknown genre")
+
+// validateGenres checks every genre against the genre catalog, id and name have to match.
+func validateGenres(ctx context.Context, genres []models.Genre) error {
+	for _, genre := range genres {
+		count, err := genreCollection.CountDocuments(ctx, bson.D{
+			bson.E{Key: "genre_id", Value: genre.GenreID},
+			bson.E{Key: "genre_name", Value: genre.GenreName},
+		})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: %s", errUnknownGenre, genre.GenreName)
 		}
 	}
-
-	return genreNames, nil
+	return nil
 }
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/oidc"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var oidcStateCollection *mongo.Collection = database.OpenCollection("oidc_states")
+
+var (
+	oidcProviders          = oidc.ProvidersFromEnv()
+	oidcStateTTL           = utils.GetEnvDuration("OIDC_STATE_TTL", 10*time.Minute)
+	oidcPostLoginURL       = utils.GetEnvString("OIDC_POST_LOGIN_REDIRECT", "http://localhost:3000/")
+	errOIDCEmailUnverified = errors.New("provider did not verify the email address")
+)
+
+// the state is also kept in a cookie so a callback only completes in the browser
+// that started the login (login csrf). It has to survive the cross-site redirect back
+// from the provider, so this does not work with COOKIE_SAMESITE=strict.
+const oidcStateCookie = "oidc_state"
+
+// BeginOIDCLogin redirects the browser to the provider's authorization endpoint.
+func BeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown identity provider"})
+		return
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start login"})
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start login"})
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start login"})
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		log.Printf("oidc provider %s unavailable: %v", provider.Name, err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": "identity provider unavailable"})
+		return
+	}
+
+	_, err = oidcStateCollection.InsertOne(r.Context(), models.OIDCState{
+		State:        state,
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start login"})
+		return
+	}
+
+	utils.SetCookie(w, oidcStateCookie, state, int(oidcStateTTL.Seconds()), true)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback exchanges the code, validates the ID token and signs the user in.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown identity provider"})
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "identity provider returned " + e})
+		return
+	}
+
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	utils.SetCookie(w, oidcStateCookie, "", -1, true)
+	if err != nil || !oidc.StateMatches(stateCookie.Value, query.Get("state")) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired login state"})
+		return
+	}
+
+	// deleting on read makes the state single use
+	var state models.OIDCState
+	err = oidcStateCollection.FindOneAndDelete(r.Context(), bson.D{
+		bson.E{Key: "state", Value: query.Get("state")},
+		bson.E{Key: "provider", Value: provider.Name},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&state)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired login state"})
+		return
+	}
+
+	tokens, err := provider.Exchange(r.Context(), query.Get("code"), state.CodeVerifier)
+	if err != nil {
+		log.Printf("oidc code exchange with %s failed: %v", provider.Name, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "sign in with identity provider failed"})
+		return
+	}
+
+	claims, err := provider.VerifyIDToken(r.Context(), tokens.IDToken, state.Nonce)
+	if err != nil {
+		log.Printf("oidc id token from %s rejected: %v", provider.Name, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "sign in with identity provider failed"})
+		return
+	}
+
+	user, err := resolveOIDCUser(r, provider, claims)
+	if errors.Is(err, errOIDCEmailUnverified) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("failed to resolve oidc user: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to sign in"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "oidc.login",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		Details:    map[string]any{"provider": provider.Name, "subject": claims.Subject},
+		IP:         utils.ClientIP(r),
+	})
+
+	// the provider handles 2fa itself, its amr claim says whether it did. If it didn't,
+	// accounts that enrolled totp here still have to pass it.
+	if user.TOTPEnabled && !claims.UsedMFA() {
+		redirectToMFA(w, r, user, oidcPostLoginURL)
+		return
+	}
+	if _, _, ok := startSession(w, r, user, utils.WithMFA(claims.UsedMFA()), utils.WithLogin(utils.LoginMethodOIDC)); !ok {
+		return
+	}
+	http.Redirect(w, r, oidcPostLoginURL, http.StatusFound)
+}
+
+// resolveOIDCUser finds the user linked to the provider account. Otherwise it links
+// the user with the same verified email, or creates a new account.
+func resolveOIDCUser(r *http.Request, provider *oidc.Provider, claims *oidc.IDTokenClaims) (models.User, error) {
+	ctx := r.Context()
+
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{
+		bson.E{Key: "identities", Value: bson.D{bson.E{Key: "$elemMatch", Value: bson.D{
+			bson.E{Key: "provider", Value: provider.Name},
+			bson.E{Key: "subject", Value: claims.Subject},
+		}}}},
+	}).Decode(&user)
+
+	switch {
+	case err == nil:
+	case err != mongo.ErrNoDocuments:
+		return user, err
+	case !claims.CanLinkByEmail():
+		return user, errOIDCEmailUnverified
+	default:
+		user, err = linkOIDCIdentity(ctx, r, provider, claims)
+		if err != nil {
+			return user, err
+		}
+	}
+
+	// groups only ever grant ADMIN, removing someone from the group doesn't demote an
+	// account that may have been made admin here
+	if provider.IsAdmin(claims) && !user.HasRole(models.RoleAdmin) {
+		_, err := userCollection.UpdateOne(ctx, bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+			bson.E{Key: "$addToSet", Value: bson.D{bson.E{Key: "roles", Value: models.RoleAdmin}}},
+			bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: time.Now()}}},
+		})
+		if err != nil {
+			return user, err
+		}
+		utils.RecordAuditEvent(ctx, models.AuditEvent{
+			Action:     "user.role_granted",
+			TargetType: "user",
+			TargetID:   user.UserID,
+			Details:    map[string]any{"provider": provider.Name, "groups": claims.Groups},
+			Before:     map[string]any{"roles": user.Roles},
+			After:      map[string]any{"roles": append(slices.Clone(user.Roles), models.RoleAdmin)},
+			IP:         utils.ClientIP(r),
+		})
+		user.Roles = append(user.Roles, models.RoleAdmin)
+	}
+	return user, nil
+}
+
+func linkOIDCIdentity(ctx context.Context, r *http.Request, provider *oidc.Provider, claims *oidc.IDTokenClaims) (models.User, error) {
+	now := time.Now()
+	identity := models.ExternalIdentity{
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: now,
+	}
+
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "email", Value: claims.Email}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return createOIDCUser(ctx, r, provider, claims, identity)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: now}}
+	if !user.IsEmailVerified() {
+		// whoever registered this address never proved they own it, and may not be the
+		// person signing in now. Drop their password so they can't keep a way in.
+		set = append(set,
+			bson.E{Key: "status", Value: models.UserStatusActive},
+			bson.E{Key: "email_verified_at", Value: now},
+			bson.E{Key: "password", Value: ""},
+		)
+		if err := utils.RevokeUserSessions(ctx, user.UserID); err != nil {
+			return user, err
+		}
+		user.Status = models.UserStatusActive
+		user.EmailVerifiedAt = &now
+	}
+
+	_, err = userCollection.UpdateOne(ctx, bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+		bson.E{Key: "$push", Value: bson.D{bson.E{Key: "identities", Value: identity}}},
+	})
+	if err != nil {
+		return user, err
+	}
+	user.Identities = append(user.Identities, identity)
+
+	utils.RecordAuditEvent(ctx, models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "oidc.linked",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		Details:    map[string]any{"provider": provider.Name, "subject": claims.Subject},
+		IP:         utils.ClientIP(r),
+	})
+	return user, nil
+}
+
+func createOIDCUser(ctx context.Context, r *http.Request, provider *oidc.Provider, claims *oidc.IDTokenClaims, identity models.ExternalIdentity) (models.User, error) {
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" {
+		firstName, lastName, _ = strings.Cut(claims.Name, " ")
+	}
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	now := time.Now()
+	user := models.User{
+		UserID:    primitive.NewObjectID().Hex(),
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     claims.Email,
+		// no password, the account signs in through the provider until the user sets one with a reset
+		Password:        "",
+		Roles:           []string{provider.DefaultRole},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		FavouriteGenres: []models.Genre{},
+		Status:          models.UserStatusActive,
+		EmailVerifiedAt: &now,
+		Identities:      []models.ExternalIdentity{identity},
+	}
+	if _, err := userCollection.InsertOne(ctx, user); err != nil {
+		return user, err
+	}
+
+	utils.RecordAuditEvent(ctx, models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "oidc.user_created",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		Details:    map[string]any{"provider": provider.Name, "subject": claims.Subject},
+		IP:         utils.ClientIP(r),
+	})
+	return user, nil
+}
@@ -0,0 +1,357 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"github.com/Chandra5468/movie-streaming/webauthn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var passkeyCollection *mongo.Collection = database.OpenCollection("passkeys")
+var webauthnSessionCollection *mongo.Collection = database.OpenCollection("webauthn_sessions")
+
+var webauthnConfig = webauthn.Config{
+	RPID:                    utils.GetEnvString("WEBAUTHN_RP_ID", "localhost"),
+	RPName:                  utils.GetEnvString("WEBAUTHN_RP_NAME", "Magic Movie Stream"),
+	Origins:                 utils.GetEnvList("WEBAUTHN_ORIGINS", []string{"http://localhost:3000"}),
+	RequireUserVerification: utils.GetEnvBool("WEBAUTHN_REQUIRE_USER_VERIFICATION", false),
+	Timeout:                 utils.GetEnvDuration("WEBAUTHN_CHALLENGE_TTL", 5*time.Minute),
+}
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// BeginPasskeyRegistration needs a recent login and the current password (or a 2fa
+// session), a passkey signs in without the password.
+func BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	// the body is optional, 2fa sessions don't need the password
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+	if !requireReauth(w, r, user, req.CurrentPassword) {
+		return
+	}
+
+	existing, err := userPasskeys(r.Context(), user.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load passkeys"})
+		return
+	}
+	var exclude [][]byte
+	for _, p := range existing {
+		if id, err := base64.RawURLEncoding.DecodeString(p.CredentialID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+
+	sessionId, challenge, err := startWebAuthnSession(r.Context(), ceremonyRegistration, user.UserID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start registration"})
+		return
+	}
+
+	options := webauthnConfig.CreationOptions(challenge, []byte(user.UserID), user.Email, user.FirstName+" "+user.LastName, exclude)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"session_id": sessionId, "public_key": options})
+}
+
+func FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	var req struct {
+		SessionID  string                        `json:"session_id"`
+		Name       string                        `json:"name"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	session, err := takeWebAuthnSession(r.Context(), req.SessionID, ceremonyRegistration)
+	if err != nil || session.UserID != userId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired registration session"})
+		return
+	}
+
+	credential, err := webauthnConfig.VerifyRegistration(session.Challenge, req.Credential)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey registration failed: " + err.Error()})
+		return
+	}
+
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	passkey := models.Passkey{
+		CredentialID: base64.RawURLEncoding.EncodeToString(credential.ID),
+		UserID:       userId,
+		Name:         req.Name,
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.SignCount,
+		Transports:   credential.Transports,
+		CreatedAt:    time.Now(),
+	}
+
+	if _, err := passkeyCollection.InsertOne(r.Context(), passkey); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "passkey already registered"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store passkey"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "passkey.registered",
+		TargetType: "passkey",
+		TargetID:   passkey.CredentialID,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&passkey)
+}
+
+func GetPasskeys(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	passkeys, err := userPasskeys(r.Context(), userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load passkeys"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&passkeys)
+}
+
+func DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	credentialId := r.PathValue("credential_id")
+	result, err := passkeyCollection.DeleteOne(r.Context(), bson.D{
+		bson.E{Key: "credential_id", Value: credentialId},
+		bson.E{Key: "user_id", Value: userId},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete passkey"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey not found"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "passkey.deleted",
+		TargetType: "passkey",
+		TargetID:   credentialId,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// BeginPasskeyLogin needs no email, the browser offers the discoverable passkeys it has for us.
+func BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	sessionId, challenge, err := startWebAuthnSession(r.Context(), ceremonyLogin, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to start login"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"session_id": sessionId, "public_key": webauthnConfig.RequestOptions(challenge, nil)})
+}
+
+func FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SessionID    string                     `json:"session_id"`
+		Credential   webauthn.AssertionResponse `json:"credential"`
+		ReturnTokens bool                       `json:"return_tokens"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	session, err := takeWebAuthnSession(r.Context(), req.SessionID, ceremonyLogin)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired login session"})
+		return
+	}
+
+	var passkey models.Passkey
+	err = passkeyCollection.FindOne(r.Context(), bson.D{bson.E{Key: "credential_id", Value: req.Credential.RawID}}).Decode(&passkey)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey login failed"})
+		return
+	}
+
+	var user models.User
+	if err := userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: passkey.UserID}}).Decode(&user); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey login failed"})
+		return
+	}
+	if loginThrottled(w, r, user.Email) {
+		return
+	}
+
+	result, err := webauthnConfig.VerifyAssertion(session.Challenge, req.Credential, passkey.PublicKey, passkey.SignCount)
+	// the authenticator's user handle is the user id we gave it at registration
+	if err != nil || (result.UserHandle != nil && string(result.UserHandle) != passkey.UserID) {
+		if err != nil {
+			log.Printf("passkey assertion for %s rejected: %v", passkey.CredentialID, err)
+		}
+		recordLoginFailure(r, user.Email)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey login failed"})
+		return
+	}
+
+	// authenticators that count signatures must move forward on every use, so of two
+	// concurrent assertions with the same count only one can match. Zero means the
+	// authenticator doesn't count at all.
+	filter := bson.D{bson.E{Key: "credential_id", Value: passkey.CredentialID}}
+	if result.SignCount > 0 {
+		filter = append(filter, bson.E{Key: "sign_count", Value: bson.D{bson.E{Key: "$lt", Value: result.SignCount}}})
+	}
+	updated, err := passkeyCollection.UpdateOne(r.Context(), filter, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "sign_count", Value: result.SignCount},
+			bson.E{Key: "last_used_at", Value: time.Now()},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update passkey"})
+		return
+	}
+	if updated.MatchedCount == 0 {
+		log.Printf("passkey %s sign count %d did not advance, possible cloned authenticator", passkey.CredentialID, result.SignCount)
+		recordLoginFailure(r, user.Email)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey login failed"})
+		return
+	}
+
+	// a passkey verified with biometrics/pin is possession + inherence, that counts as 2fa.
+	// Without verification it is just something the user has, accounts with totp still
+	// need their code or a stolen security key alone would get in.
+	if user.TOTPEnabled && !result.UserVerified {
+		requireMFA(w, user)
+		return
+	}
+	completeLogin(w, r, user, req.ReturnTokens, utils.WithMFA(result.UserVerified), utils.WithLogin(utils.LoginMethodPasskey))
+}
+
+func userPasskeys(ctx context.Context, userId string) ([]models.Passkey, error) {
+	cursor, err := passkeyCollection.Find(ctx, bson.D{bson.E{Key: "user_id", Value: userId}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	passkeys := []models.Passkey{}
+	if err := cursor.All(ctx, &passkeys); err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+func startWebAuthnSession(ctx context.Context, ceremony, userId string) (string, []byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+	sessionId, _, err := utils.NewOpaqueToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = webauthnSessionCollection.InsertOne(ctx, models.WebAuthnSession{
+		SessionID: sessionId,
+		Challenge: challenge,
+		UserID:    userId,
+		Ceremony:  ceremony,
+		ExpiresAt: time.Now().Add(webauthnConfig.Timeout),
+	})
+	return sessionId, challenge, err
+}
+
+// takeWebAuthnSession deletes the session as it reads it so a challenge is only ever used once.
+func takeWebAuthnSession(ctx context.Context, sessionId, ceremony string) (models.WebAuthnSession, error) {
+	var session models.WebAuthnSession
+	err := webauthnSessionCollection.FindOneAndDelete(ctx, bson.D{
+		bson.E{Key: "session_id", Value: sessionId},
+		bson.E{Key: "ceremony", Value: ceremony},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&session)
+	return session, err
+}
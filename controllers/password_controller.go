@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/mailer"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var passwordResetCollection *mongo.Collection = database.OpenCollection("password_resets")
+
+var (
+	passwordResetTTL = utils.GetEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+	resetPasswordURL = utils.GetEnvString("RESET_PASSWORD_URL", "http://localhost:3000/reset-password")
+	// at most PASSWORD_RESET_MAX_PER_WINDOW links per email every PASSWORD_RESET_RATE_WINDOW (up to a day)
+	passwordResetMaxPerWindow = utils.GetEnvInt("PASSWORD_RESET_MAX_PER_WINDOW", 3)
+	passwordResetRateWindow   = utils.GetEnvDuration("PASSWORD_RESET_RATE_WINDOW", time.Hour)
+)
+
+// ForgotPassword emails a reset link. The response is the same whether or not the
+// email is registered or rate limited, and the lookup + mail happen after responding
+// so timing doesn't give it away either.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+
+	go func(email string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := sendPasswordReset(ctx, email); err != nil {
+			log.Printf("failed to send password reset: %v", err)
+		}
+	}(req.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the address is registered a reset link has been sent"})
+}
+
+func sendPasswordReset(ctx context.Context, email string) error {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "email", Value: email}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed, err := utils.AllowEmail(ctx, utils.EmailKindPasswordReset, user.Email, passwordResetMaxPerWindow, passwordResetRateWindow)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("password reset for %s not sent, rate limit reached", user.UserID)
+		return nil
+	}
+
+	token, hash, err := utils.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	// only the newest link works
+	if _, err := passwordResetCollection.DeleteMany(ctx, bson.D{
+		bson.E{Key: "user_id", Value: user.UserID},
+		bson.E{Key: "used_at", Value: nil},
+	}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = passwordResetCollection.InsertOne(ctx, models.PasswordReset{
+		TokenHash: hash,
+		UserID:    user.UserID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := resetPasswordURL + "?token=" + url.QueryEscape(token)
+	return mailer.Default.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"Someone asked to reset the password of your account. If that was you, open the link below, it expires in " + passwordResetTTL.String() + ".\n\n" +
+			link + "\n\n" +
+			"If it wasn't you, you can ignore this email.\n",
+	})
+}
+
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token and password required"})
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now()
+	tokenFilter := bson.D{
+		bson.E{Key: "token_hash", Value: utils.HashOpaqueToken(req.Token)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+	}
+
+	var reset models.PasswordReset
+	if err := passwordResetCollection.FindOne(ctx, tokenFilter).Decode(&reset); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired reset link"})
+		return
+	}
+
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "user_id", Value: reset.UserID}}).Decode(&user); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired reset link"})
+		return
+	}
+
+	// check the policy before burning the token so the user can try another password
+	if problems := utils.DefaultPasswordPolicy.Check(req.Password, user.Email, user.FirstName, user.LastName); len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password does not meet the password policy", "details": problems})
+		return
+	}
+
+	hashedPwd, err := utils.HashPassword(req.Password)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password not stored"})
+		return
+	}
+
+	// marking it used in the same filter makes the token single use even with concurrent requests
+	result, err := passwordResetCollection.UpdateOne(ctx, tokenFilter, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}},
+	})
+	if err != nil || result.ModifiedCount == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired reset link"})
+		return
+	}
+
+	_, err = userCollection.UpdateOne(ctx, bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "password", Value: hashedPwd},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password not stored"})
+		return
+	}
+
+	if err := utils.RevokeUserSessions(ctx, user.UserID); err != nil {
+		log.Printf("failed to revoke sessions for %s: %v", user.UserID, err)
+	}
+	if err := utils.ResetLoginFailures(ctx, user.Email); err != nil {
+		log.Printf("failed to reset login attempts for %s: %v", user.UserID, err)
+	}
+
+	utils.RecordAuditEvent(ctx, models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "password.reset",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
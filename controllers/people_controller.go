@@ -0,0 +1,585 @@
+package controllers
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var personCollection *mongo.Collection = database.OpenCollection("people")
+
+var errUnknownPerson = errors.New("unknown person")
+
+// credits are listed directors first, then writers, then the cast in billing order
+var creditRoleOrder = []string{models.CreditDirector, models.CreditWriter, models.CreditActor}
+
+// SearchPeople lists people, ?q= matches the start of the name.
+func SearchPeople(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+
+	filter := bson.D{}
+	if q := r.URL.Query().Get("q"); q != "" {
+		filter = bson.D{bson.E{Key: "name", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q), Options: "i"}}}
+	}
+
+	total, err := personCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search people"})
+		return
+	}
+	cursor, err := personCollection.Find(r.Context(), filter, options.Find().
+		SetSort(bson.D{bson.E{Key: "name", Value: 1}}).
+		SetSkip(int64((page-1)*perPage)).
+		SetLimit(int64(perPage)))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search people"})
+		return
+	}
+	people := []models.Person{}
+	if err := cursor.All(r.Context(), &people); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to search people"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"people": people, "page": page, "per_page": perPage, "total": total})
+}
+
+// GetPerson returns the person with their filmography, limited to the titles the active
+// profile may see.
+func GetPerson(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	person, ok := loadPerson(w, r)
+	if !ok {
+		return
+	}
+
+	filter := catalogFilter(profile, bson.D{bson.E{Key: "credits.person_id", Value: person.PersonID}})
+	var movies []models.Movie
+	cursor, err := movieCollection.Find(r.Context(), filter)
+	if err == nil {
+		err = cursor.All(r.Context(), &movies)
+	}
+	var series []models.Series
+	if err == nil {
+		cursor, err = seriesCollection.Find(r.Context(), filter)
+	}
+	if err == nil {
+		err = cursor.All(r.Context(), &series)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load filmography"})
+		return
+	}
+
+	titles := []models.Title{}
+	for _, movie := range movies {
+		titles = append(titles, movie)
+	}
+	for _, s := range series {
+		titles = append(titles, s)
+	}
+
+	detail := models.PersonDetail{Person: person, Filmography: []models.FilmographyEntry{}}
+	for _, title := range titles {
+		for _, credit := range title.TitleCredits() {
+			if credit.PersonID != person.PersonID {
+				continue
+			}
+			detail.Filmography = append(detail.Filmography, models.FilmographyEntry{
+				ImdbID:     title.TitleID(),
+				TitleType:  title.TitleType(),
+				Title:      title.TitleName(),
+				PosterPath: title.TitlePoster(),
+				Role:       credit.Role,
+				Character:  credit.Character,
+				Order:      credit.Order,
+			})
+		}
+	}
+	slices.SortFunc(detail.Filmography, func(a, b models.FilmographyEntry) int {
+		return cmp.Or(cmp.Compare(a.Title, b.Title), cmp.Compare(a.Role, b.Role))
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&detail)
+}
+
+func CreatePerson(w http.ResponseWriter, r *http.Request) {
+	var person models.Person
+	if err := json.NewDecoder(r.Body).Decode(&person); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(person); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	if !validExternalIDs(w, person.ExternalIDs) {
+		return
+	}
+
+	person.ID = primitive.NilObjectID
+	person.PersonID = primitive.NewObjectID().Hex()
+	person.CreatedAt = time.Now()
+	person.UpdatedAt = person.CreatedAt
+	_, err := personCollection.InsertOne(r.Context(), person)
+	if mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a person with this external id already exists"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while inserting person"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "person.created",
+		TargetType: "person",
+		TargetID:   person.PersonID,
+		After:      personAuditState(person),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&person)
+}
+
+// UpsertPersonByExternalID is for importers: it creates the person with the external id
+// or updates the one that has it, so running an import twice doesn't duplicate anyone.
+func UpsertPersonByExternalID(w http.ResponseWriter, r *http.Request) {
+	source, externalId := r.PathValue("source"), r.PathValue("external_id")
+	if !slices.Contains(models.PersonSources, source) || externalId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown external id source " + source})
+		return
+	}
+
+	var req struct {
+		Name        string     `json:"name" validate:"required,min=1,max=200"`
+		Biography   string     `json:"biography" validate:"max=10000"`
+		ProfilePath string     `json:"profile_path" validate:"omitempty,url"`
+		BirthDate   *time.Time `json:"birth_date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	now := time.Now()
+	set := bson.D{
+		bson.E{Key: "name", Value: req.Name},
+		bson.E{Key: "biography", Value: req.Biography},
+		bson.E{Key: "profile_path", Value: req.ProfilePath},
+		bson.E{Key: "updated_at", Value: now},
+	}
+	if req.BirthDate != nil {
+		set = append(set, bson.E{Key: "birth_date", Value: *req.BirthDate})
+	}
+	filter := bson.D{bson.E{Key: "external_ids." + source, Value: externalId}}
+	update := bson.D{
+		bson.E{Key: "$set", Value: set},
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "person_id", Value: primitive.NewObjectID().Hex()},
+			bson.E{Key: "created_at", Value: now},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var before models.Person
+	err := personCollection.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&before)
+	// two imports upserting the same person at once, the loser finds it on the second try
+	if mongo.IsDuplicateKeyError(err) {
+		err = personCollection.FindOneAndUpdate(r.Context(), filter, update, opts).Decode(&before)
+	}
+	created := err == mongo.ErrNoDocuments
+	if err != nil && !created {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while saving person"})
+		return
+	}
+
+	var person models.Person
+	if err := personCollection.FindOne(r.Context(), filter).Decode(&person); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while saving person"})
+		return
+	}
+	if !created && before.Name != person.Name {
+		if err := renameCredits(r.Context(), person.PersonID, person.Name); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to update credits"})
+			return
+		}
+	}
+
+	event := models.AuditEvent{
+		Action:     "person.updated",
+		TargetType: "person",
+		TargetID:   person.PersonID,
+		After:      personAuditState(person),
+		IP:         utils.ClientIP(r),
+	}
+	event.ActorID, _ = utils.GetDataFromContext(r)
+	status := http.StatusOK
+	if created {
+		event.Action = "person.created"
+		status = http.StatusCreated
+	} else {
+		event.Before = personAuditState(before)
+	}
+	utils.RecordAuditEvent(r.Context(), event)
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&person)
+}
+
+// UpdatePerson changes a person, fields left out of the body are kept. external_ids
+// replaces all of them.
+func UpdatePerson(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        *string           `json:"name" validate:"omitempty,min=1,max=200"`
+		Biography   *string           `json:"biography" validate:"omitempty,max=10000"`
+		ProfilePath *string           `json:"profile_path" validate:"omitempty,url"`
+		BirthDate   *time.Time        `json:"birth_date"`
+		ExternalIDs map[string]string `json:"external_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	if !validExternalIDs(w, req.ExternalIDs) {
+		return
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: time.Now()}}
+	if req.Name != nil {
+		set = append(set, bson.E{Key: "name", Value: *req.Name})
+	}
+	if req.Biography != nil {
+		set = append(set, bson.E{Key: "biography", Value: *req.Biography})
+	}
+	if req.ProfilePath != nil {
+		set = append(set, bson.E{Key: "profile_path", Value: *req.ProfilePath})
+	}
+	if req.BirthDate != nil {
+		set = append(set, bson.E{Key: "birth_date", Value: *req.BirthDate})
+	}
+	if req.ExternalIDs != nil {
+		set = append(set, bson.E{Key: "external_ids", Value: req.ExternalIDs})
+	}
+
+	var before models.Person
+	err := personCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "person_id", Value: r.PathValue("person_id")}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	}).Decode(&before)
+	if mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a person with this external id already exists"})
+		return
+	}
+	if !personUpdated(w, err) {
+		return
+	}
+	person, ok := loadPerson(w, r)
+	if !ok {
+		return
+	}
+	if before.Name != person.Name {
+		if err := renameCredits(r.Context(), person.PersonID, person.Name); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to update credits"})
+			return
+		}
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "person.updated",
+		TargetType: "person",
+		TargetID:   person.PersonID,
+		Before:     personAuditState(before),
+		After:      personAuditState(person),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&person)
+}
+
+// DeletePerson only removes people that aren't credited on any title.
+func DeletePerson(w http.ResponseWriter, r *http.Request) {
+	personId := r.PathValue("person_id")
+	credited := bson.D{bson.E{Key: "credits.person_id", Value: personId}}
+	for _, collection := range []*mongo.Collection{movieCollection, seriesCollection} {
+		count, err := collection.CountDocuments(r.Context(), credited)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to check credits"})
+			return
+		}
+		if count > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "person is still credited on titles"})
+			return
+		}
+	}
+
+	var before models.Person
+	err := personCollection.FindOneAndDelete(r.Context(), bson.D{bson.E{Key: "person_id", Value: personId}}).Decode(&before)
+	if !personUpdated(w, err) {
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "person.deleted",
+		TargetType: "person",
+		TargetID:   before.PersonID,
+		Before:     personAuditState(before),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// SetMovieCredits replaces the cast and crew of a movie.
+func SetMovieCredits(w http.ResponseWriter, r *http.Request) {
+	setTitleCredits(w, r, movieCollection, "movie", r.PathValue("imdb_id"))
+}
+
+// SetSeriesCredits replaces the cast and crew of a series.
+func SetSeriesCredits(w http.ResponseWriter, r *http.Request) {
+	setTitleCredits(w, r, seriesCollection, "series", r.PathValue("series_id"))
+}
+
+func setTitleCredits(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, titleType, imdbId string) {
+	var req struct {
+		Credits []models.Credit `json:"credits" validate:"dive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	if !validCredits(w, r, req.Credits) {
+		return
+	}
+	if req.Credits == nil {
+		req.Credits = []models.Credit{}
+	}
+
+	var before struct {
+		Credits []models.Credit `bson:"credits"`
+	}
+	err := collection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: imdbId}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "credits", Value: req.Credits}}},
+	}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Title not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update credits"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     titleType + ".credits_updated",
+		TargetType: titleType,
+		TargetID:   imdbId,
+		Before:     map[string]any{"credits": before.Credits},
+		After:      map[string]any{"credits": req.Credits},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"credits": req.Credits})
+}
+
+// validCredits checks that every credited person exists, fills in their names and puts
+// the credits in listing order. It writes the error response itself.
+func validCredits(w http.ResponseWriter, r *http.Request, credits []models.Credit) bool {
+	if err := resolveCredits(r.Context(), credits); err != nil {
+		if errors.Is(err, errUnknownPerson) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to check credits"})
+		return false
+	}
+	return true
+}
+
+func resolveCredits(ctx context.Context, credits []models.Credit) error {
+	if len(credits) == 0 {
+		return nil
+	}
+	ids := []string{}
+	for _, credit := range credits {
+		ids = append(ids, credit.PersonID)
+	}
+	cursor, err := personCollection.Find(ctx, bson.D{bson.E{Key: "person_id", Value: bson.D{bson.E{Key: "$in", Value: ids}}}},
+		options.Find().SetProjection(bson.D{bson.E{Key: "person_id", Value: 1}, bson.E{Key: "name", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var people []models.Person
+	if err := cursor.All(ctx, &people); err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for _, person := range people {
+		names[person.PersonID] = person.Name
+	}
+
+	for i := range credits {
+		name, ok := names[credits[i].PersonID]
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownPerson, credits[i].PersonID)
+		}
+		credits[i].Name = name
+	}
+	slices.SortStableFunc(credits, func(a, b models.Credit) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(creditRoleOrder, a.Role), slices.Index(creditRoleOrder, b.Role)),
+			cmp.Compare(a.Order, b.Order),
+		)
+	})
+	return nil
+}
+
+// renameCredits copies a new name of a person into the credits of every title.
+func renameCredits(ctx context.Context, personId, name string) error {
+	for _, collection := range []*mongo.Collection{movieCollection, seriesCollection} {
+		_, err := collection.UpdateMany(ctx,
+			bson.D{bson.E{Key: "credits.person_id", Value: personId}},
+			bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "credits.$[credit].name", Value: name}}}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []any{
+				bson.D{bson.E{Key: "credit.person_id", Value: personId}},
+			}}),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// personFilter narrows a catalog query down to titles crediting ?person_id=, optionally
+// only in ?role= (actor, director or writer).
+func personFilter(r *http.Request, filter bson.D) bson.D {
+	personId := r.URL.Query().Get("person_id")
+	if personId == "" {
+		return filter
+	}
+	match := bson.D{bson.E{Key: "person_id", Value: personId}}
+	if role := r.URL.Query().Get("role"); role != "" {
+		match = append(match, bson.E{Key: "role", Value: role})
+	}
+	return append(filter, bson.E{Key: "credits", Value: bson.D{bson.E{Key: "$elemMatch", Value: match}}})
+}
+
+func validExternalIDs(w http.ResponseWriter, ids map[string]string) bool {
+	for source, id := range ids {
+		if !slices.Contains(models.PersonSources, source) || strings.TrimSpace(id) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid external id for " + source})
+			return false
+		}
+	}
+	return true
+}
+
+func loadPerson(w http.ResponseWriter, r *http.Request) (models.Person, bool) {
+	var person models.Person
+	err := personCollection.FindOne(r.Context(), bson.D{bson.E{Key: "person_id", Value: r.PathValue("person_id")}}).Decode(&person)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Person not found"})
+		return person, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load person"})
+		return person, false
+	}
+	return person, true
+}
+
+func personUpdated(w http.ResponseWriter, err error) bool {
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Person not found"})
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error updating person"})
+		return false
+	}
+	return true
+}
+
+func personAuditState(person models.Person) map[string]any {
+	return map[string]any{
+		"name":         person.Name,
+		"profile_path": person.ProfilePath,
+		"birth_date":   person.BirthDate,
+		"external_ids": person.ExternalIDs,
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/privacy"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RequestDataExport queues an export of everything we hold about the user. The user
+// is emailed when the archive can be downloaded.
+func RequestDataExport(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	enqueuePrivacyJob(w, r, models.PrivacyJobExport, userId, userId)
+}
+
+func GetPrivacyJobs(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	jobs, err := privacy.UserJobs(r.Context(), userId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load jobs"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&jobs)
+}
+
+func DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	job, err := privacy.GetJob(r.Context(), r.PathValue("job_id"))
+	if err == nil && job.UserID != userId {
+		err = privacy.ErrJobNotFound
+	}
+	var path string
+	if err == nil {
+		path, err = privacy.ArchivePath(job)
+	}
+	switch {
+	case errors.Is(err, privacy.ErrJobNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "export not found"})
+		return
+	case errors.Is(err, privacy.ErrArchiveExpired):
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load export"})
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="data-export-`+job.JobID+`.json"`)
+	http.ServeFile(w, r, path)
+}
+
+// AdminRequestExport exports a user's data on their behalf, e.g. for a request that
+// came in through support. The archive is still only downloadable by the user.
+func AdminRequestExport(w http.ResponseWriter, r *http.Request) {
+	adminRequestPrivacyJob(w, r, models.PrivacyJobExport)
+}
+
+// AdminRequestErasure erases a user right away, without the grace period of DELETE /api/me.
+func AdminRequestErasure(w http.ResponseWriter, r *http.Request) {
+	adminRequestPrivacyJob(w, r, models.PrivacyJobErasure)
+}
+
+func GetPrivacyJob(w http.ResponseWriter, r *http.Request) {
+	job, err := privacy.GetJob(r.Context(), r.PathValue("job_id"))
+	if errors.Is(err, privacy.ErrJobNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load job"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&job)
+}
+
+func adminRequestPrivacyJob(w http.ResponseWriter, r *http.Request, jobType string) {
+	adminId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	userId := r.PathValue("user_id")
+	count, err := userCollection.CountDocuments(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load user"})
+		return
+	}
+	if count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+
+	if jobType == models.PrivacyJobErasure {
+		if err := utils.RevokeUserSessions(r.Context(), userId); err != nil {
+			log.Printf("failed to revoke sessions for %s: %v", userId, err)
+		}
+	}
+	enqueuePrivacyJob(w, r, jobType, userId, adminId)
+}
+
+func enqueuePrivacyJob(w http.ResponseWriter, r *http.Request, jobType, userId, requestedBy string) {
+	job, err := privacy.Enqueue(r.Context(), jobType, userId, requestedBy)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to queue job"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    requestedBy,
+		Action:     "privacy." + jobType + "_requested",
+		TargetType: "user",
+		TargetID:   userId,
+		Details:    map[string]any{"job_id": job.JobID},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&job)
+}
@@ -0,0 +1,533 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var profileCollection *mongo.Collection = database.OpenCollection("profiles")
+
+// Wrong PINs lock switching out of kids profiles for PROFILE_PIN_LOCKOUT after
+// PROFILE_PIN_MAX_ATTEMPTS in a row, a 4 digit PIN doesn't survive guessing otherwise.
+var (
+	profilePINMaxAttempts = utils.GetEnvInt("PROFILE_PIN_MAX_ATTEMPTS", 5)
+	profilePINLockout     = utils.GetEnvDuration("PROFILE_PIN_LOCKOUT", 15*time.Minute)
+)
+
+// GetProfiles lists the account's profiles for the profile picker.
+func GetProfiles(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
+
+	// makes sure accounts from before profiles have theirs
+	if _, err := utils.DefaultProfile(r.Context(), userId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load profiles"})
+		return
+	}
+
+	cursor, err := profileCollection.Find(r.Context(), bson.D{bson.E{Key: "user_id", Value: userId}},
+		options.Find().SetSort(bson.D{bson.E{Key: "created_at", Value: 1}}))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load profiles"})
+		return
+	}
+	profiles := []models.Profile{}
+	if err := cursor.All(r.Context(), &profiles); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load profiles"})
+		return
+	}
+
+	claimed, _ := r.Context().Value(utils.ProfileID).(string)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"profiles": profiles, "selected": claimed, "max_profiles": utils.MaxProfilesPerAccount})
+}
+
+func CreateProfile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+
+	var req struct {
+		Name            string         `json:"name" validate:"required,min=1,max=30"`
+		Avatar          string         `json:"avatar" validate:"omitempty,url"`
+		FavouriteGenres []models.Genre `json:"favourite_genres" validate:"omitempty,dive"`
+		MaturityLevel   *int           `json:"maturity_level" validate:"omitempty,min=0,max=18"`
+		Kids            bool           `json:"kids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	profile := models.Profile{
+		ProfileID:       primitive.NewObjectID().Hex(),
+		UserID:          user.UserID,
+		Name:            req.Name,
+		Avatar:          req.Avatar,
+		FavouriteGenres: req.FavouriteGenres,
+		MaturityLevel:   models.MaturityAdult,
+		Kids:            req.Kids,
+	}
+	if profile.Kids {
+		profile.MaturityLevel = models.MaturityKidsMax
+	}
+	if req.MaturityLevel != nil {
+		profile.MaturityLevel = *req.MaturityLevel
+	}
+	if profile.FavouriteGenres == nil {
+		profile.FavouriteGenres = []models.Genre{}
+	}
+	if !validProfile(w, r, user, profile) {
+		return
+	}
+
+	count, err := profileCollection.CountDocuments(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create profile"})
+		return
+	}
+	if count >= int64(utils.MaxProfilesPerAccount) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "profile limit reached"})
+		return
+	}
+
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+	if _, err := profileCollection.InsertOne(r.Context(), profile); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create profile"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// UpdateProfile changes a profile, fields left out of the body are kept.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+
+	var req struct {
+		Name            *string        `json:"name" validate:"omitempty,min=1,max=30"`
+		Avatar          *string        `json:"avatar" validate:"omitempty,url"`
+		FavouriteGenres []models.Genre `json:"favourite_genres" validate:"omitempty,dive"`
+		MaturityLevel   *int           `json:"maturity_level" validate:"omitempty,min=0,max=18"`
+		Kids            *bool          `json:"kids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := loadProfile(w, r, user.UserID)
+	if !ok {
+		return
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: time.Now()}}
+	if req.Name != nil {
+		profile.Name = *req.Name
+		set = append(set, bson.E{Key: "name", Value: profile.Name})
+	}
+	if req.Avatar != nil {
+		profile.Avatar = *req.Avatar
+		set = append(set, bson.E{Key: "avatar", Value: profile.Avatar})
+	}
+	if req.FavouriteGenres != nil {
+		profile.FavouriteGenres = req.FavouriteGenres
+		set = append(set, bson.E{Key: "favourite_genres", Value: profile.FavouriteGenres})
+	}
+	if req.Kids != nil {
+		profile.Kids = *req.Kids
+		set = append(set, bson.E{Key: "kids", Value: profile.Kids})
+		// turning a profile into a kids profile brings it down to the kids level unless one is given
+		if profile.Kids && req.MaturityLevel == nil {
+			profile.MaturityLevel = min(profile.MaturityLevel, models.MaturityKidsMax)
+			set = append(set, bson.E{Key: "maturity_level", Value: profile.MaturityLevel})
+		}
+	}
+	if req.MaturityLevel != nil {
+		profile.MaturityLevel = *req.MaturityLevel
+		set = append(set, bson.E{Key: "maturity_level", Value: profile.MaturityLevel})
+	}
+	if !validProfile(w, r, user, profile) {
+		return
+	}
+
+	_, err := profileCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "profile_id", Value: profile.ProfileID}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update profile"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// DeleteProfile removes a profile with its watchlist and history. The default profile
+// and the one the request acts as can't be deleted.
+func DeleteProfile(w http.ResponseWriter, r *http.Request) {
+	active, ok := requireAdultProfile(w, r)
+	if !ok {
+		return
+	}
+	userId, _ := utils.GetDataFromContext(r)
+	profile, ok := loadProfile(w, r, userId)
+	if !ok {
+		return
+	}
+	if profile.Default {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "the default profile cannot be deleted"})
+		return
+	}
+	if profile.ProfileID == active.ProfileID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "cannot delete the profile in use"})
+		return
+	}
+
+	filter := bson.D{bson.E{Key: "profile_id", Value: profile.ProfileID}}
+	if _, err := profileCollection.DeleteOne(r.Context(), filter); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete profile"})
+		return
+	}
+	for _, collection := range []*mongo.Collection{watchlistCollection, watchHistoryCollection} {
+		if _, err := collection.DeleteMany(r.Context(), filter); err != nil {
+			log.Printf("failed to clean up %s for profile %s: %v", collection.Name(), profile.ProfileID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// BlockTitle hides a movie from a profile whatever its rating.
+func BlockTitle(w http.ResponseWriter, r *http.Request) {
+	setTitleBlocked(w, r, "$addToSet")
+}
+
+func UnblockTitle(w http.ResponseWriter, r *http.Request) {
+	setTitleBlocked(w, r, "$pull")
+}
+
+func setTitleBlocked(w http.ResponseWriter, r *http.Request, op string) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+	userId, _ := utils.GetDataFromContext(r)
+	imdbId := r.PathValue("imdb_id")
+
+	var profile models.Profile
+	err := profileCollection.FindOneAndUpdate(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "profile_id", Value: r.PathValue("profile_id")},
+	}, bson.D{
+		bson.E{Key: op, Value: bson.D{bson.E{Key: "blocked_titles", Value: imdbId}}},
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: time.Now()}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "profile not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update profile"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// SelectProfile switches the session to a profile by issuing new tokens that name it.
+// Leaving a kids profile for one that isn't needs the account's profile PIN.
+func SelectProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PIN string `json:"pin"`
+	}
+	// the pin is only needed when leaving a kids profile, an empty body is fine
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+			return
+		}
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+	profile, ok := loadProfile(w, r, user.UserID)
+	if !ok {
+		return
+	}
+
+	claimed, _ := r.Context().Value(utils.ProfileID).(string)
+	pinRequired, err := utils.ProfilePINRequired(r.Context(), user.UserID, claimed, profile)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load profile"})
+		return
+	}
+	if pinRequired && !checkProfilePIN(w, r, user, req.PIN) {
+		return
+	}
+
+	mfa, _ := r.Context().Value(utils.MFA).(bool)
+	token, refreshToken, ok := startSession(w, r, user, utils.WithMFA(mfa), utils.WithProfile(profile.ProfileID), utils.KeepLogin(r.Context()))
+	if !ok {
+		return
+	}
+	resp := map[string]any{"profile": profile}
+	if isNonBrowserClient(r) {
+		resp["token"] = token
+		resp["refresh_token"] = refreshToken
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// SetProfilePIN sets or changes the PIN that guards leaving kids profiles. It needs the
+// account password, if the account has one.
+func SetProfilePIN(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdultProfile(w, r); !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		PIN             string `json:"pin" validate:"required,numeric,min=4,max=6"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "pin must be 4 to 6 digits"})
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.Password != "" {
+		match, _, err := utils.VerifyPassword(user.Password, req.CurrentPassword)
+		if err != nil {
+			log.Printf("failed to verify password for %s: %v", user.UserID, err)
+		}
+		if !match {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "current password is incorrect"})
+			return
+		}
+	}
+
+	hashedPIN, err := utils.HashPassword(req.PIN)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "pin not stored"})
+		return
+	}
+	_, err = userCollection.UpdateOne(r.Context(), bson.D{bson.E{Key: "user_id", Value: user.UserID}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "profile_pin", Value: hashedPIN},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+		bson.E{Key: "$unset", Value: bson.D{
+			bson.E{Key: "profile_pin_failures", Value: ""},
+			bson.E{Key: "profile_pin_locked_until", Value: ""},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "pin not stored"})
+		return
+	}
+
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    user.UserID,
+		Action:     "profile.pin_set",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// checkProfilePIN compares pin against the account's profile PIN, counting failures
+// towards the lockout. It writes the error response itself.
+func checkProfilePIN(w http.ResponseWriter, r *http.Request, user models.User, pin string) bool {
+	if user.ProfilePIN == "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no profile PIN is set, sign in again to leave this profile"})
+		return false
+	}
+	if user.ProfilePINLockedUntil != nil && user.ProfilePINLockedUntil.After(time.Now()) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "too many incorrect PINs, try again later"})
+		return false
+	}
+
+	filter := bson.D{bson.E{Key: "user_id", Value: user.UserID}}
+	match, _, err := utils.VerifyPassword(user.ProfilePIN, pin)
+	if err != nil {
+		log.Printf("failed to verify profile pin for %s: %v", user.UserID, err)
+	}
+	if !match {
+		var after models.User
+		err := userCollection.FindOneAndUpdate(r.Context(), filter, bson.D{
+			bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "profile_pin_failures", Value: 1}}},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+		if err != nil {
+			log.Printf("failed to record profile pin failure for %s: %v", user.UserID, err)
+		} else if after.ProfilePINFailures >= profilePINMaxAttempts {
+			_, err = userCollection.UpdateOne(r.Context(), filter, bson.D{
+				bson.E{Key: "$set", Value: bson.D{bson.E{Key: "profile_pin_locked_until", Value: time.Now().Add(profilePINLockout)}}},
+				bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "profile_pin_failures", Value: ""}}},
+			})
+			if err != nil {
+				log.Printf("failed to lock profile pin for %s: %v", user.UserID, err)
+			}
+			utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+				Action:     "profile.pin_locked",
+				TargetType: "user",
+				TargetID:   user.UserID,
+				IP:         utils.ClientIP(r),
+			})
+		}
+
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "incorrect PIN"})
+		return false
+	}
+
+	if user.ProfilePINFailures > 0 {
+		_, err := userCollection.UpdateOne(r.Context(), filter, bson.D{
+			bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "profile_pin_failures", Value: ""}}},
+		})
+		if err != nil {
+			log.Printf("failed to reset profile pin failures for %s: %v", user.UserID, err)
+		}
+	}
+	return true
+}
+
+// requireAdultProfile stops kids profiles from managing profiles, they could lift their
+// own restrictions otherwise. It needs the ActiveProfile middleware.
+func requireAdultProfile(w http.ResponseWriter, r *http.Request) (models.Profile, bool) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return profile, false
+	}
+	if profile.Kids {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not allowed from a kids profile"})
+		return profile, false
+	}
+	return profile, true
+}
+
+// loadProfile loads the {profile_id} of the path, it has to belong to userId.
+func loadProfile(w http.ResponseWriter, r *http.Request, userId string) (models.Profile, bool) {
+	profile, err := utils.GetProfile(r.Context(), userId, r.PathValue("profile_id"))
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "profile not found"})
+		return profile, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load profile"})
+		return profile, false
+	}
+	return profile, true
+}
+
+// validProfile checks the rules a profile has to keep after a create or update.
+func validProfile(w http.ResponseWriter, r *http.Request, user models.User, profile models.Profile) bool {
+	if profile.Kids {
+		if profile.Default {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "the default profile cannot be a kids profile"})
+			return false
+		}
+		if profile.MaturityLevel > models.MaturityKidsMax {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "maturity level too high for a kids profile"})
+			return false
+		}
+		// without a PIN nothing keeps the kids profile from switching to another one
+		if user.ProfilePIN == "" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "set a profile PIN before adding a kids profile"})
+			return false
+		}
+	}
+	if err := validateGenres(r.Context(), profile.FavouriteGenres); err != nil {
+		if errors.Is(err, errUnknownGenre) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to check genres"})
+		return false
+	}
+	return true
+}
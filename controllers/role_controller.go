@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var roleCollection *mongo.Collection = database.OpenCollection("roles")
+
+func GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := utils.AllRoles(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load roles"})
+		return
+	}
+
+	list := []models.Role{}
+	for _, role := range roles {
+		list = append(list, role)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"roles": list, "permissions": models.AllPermissions})
+}
+
+func CreateRole(w http.ResponseWriter, r *http.Request) {
+	var role models.Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if !validRole(w, &role) {
+		return
+	}
+	if !canGrant(w, r, role.Permissions) {
+		return
+	}
+
+	now := time.Now()
+	role.BuiltIn = false
+	role.CreatedAt = now
+	role.UpdatedAt = now
+	if _, err := roleCollection.InsertOne(r.Context(), role); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "role already exists"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create role"})
+		return
+	}
+	utils.InvalidateRoleCache()
+
+	adminId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "role.created",
+		TargetType: "role",
+		TargetID:   role.Name,
+		After:      map[string]any{"description": role.Description, "permissions": role.Permissions},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&role)
+}
+
+// UpdateRole changes the description and permissions. Running sessions pick the new
+// permissions up within RBAC_CACHE_TTL, no sign-out needed.
+// Only permissions the caller holds can be added.
+func UpdateRole(w http.ResponseWriter, r *http.Request) {
+	var role models.Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	role.Name = r.PathValue("name")
+	if !validRole(w, &role) {
+		return
+	}
+
+	// ADMIN is reset to every permission on start, editing it would be confusing at best.
+	// Every account holds USER, a permission on it would go to everyone.
+	if role.Name == models.RoleAdmin || role.Name == models.RoleUser {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "built-in roles cannot be changed"})
+		return
+	}
+
+	var before models.Role
+	err := roleCollection.FindOne(r.Context(), bson.D{bson.E{Key: "name", Value: role.Name}}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "role not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update role"})
+		return
+	}
+	added := []string{}
+	for _, perm := range role.Permissions {
+		if !slices.Contains(before.Permissions, perm) {
+			added = append(added, perm)
+		}
+	}
+	if !canGrant(w, r, added) {
+		return
+	}
+
+	// matching the permissions that were checked, a concurrent change makes this one fail
+	err = roleCollection.FindOneAndUpdate(r.Context(), bson.D{
+		bson.E{Key: "name", Value: role.Name},
+		bson.E{Key: "permissions", Value: before.Permissions},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "description", Value: role.Description},
+			bson.E{Key: "permissions", Value: role.Permissions},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+	}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "role was changed meanwhile, try again"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update role"})
+		return
+	}
+	utils.InvalidateRoleCache()
+
+	adminId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "role.updated",
+		TargetType: "role",
+		TargetID:   role.Name,
+		Before:     map[string]any{"description": before.Description, "permissions": before.Permissions},
+		After:      map[string]any{"description": role.Description, "permissions": role.Permissions},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// DeleteRole removes a custom role that nobody holds anymore.
+func DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == models.RoleAdmin || name == models.RoleUser {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "built-in roles cannot be deleted"})
+		return
+	}
+
+	holders, err := userCollection.CountDocuments(r.Context(), bson.D{bson.E{Key: "roles", Value: name}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete role"})
+		return
+	}
+	if holders > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{"error": "role is still assigned to users", "users": holders})
+		return
+	}
+
+	result, err := roleCollection.DeleteOne(r.Context(), bson.D{
+		bson.E{Key: "name", Value: name},
+		bson.E{Key: "built_in", Value: false},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete role"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "role not found"})
+		return
+	}
+	utils.InvalidateRoleCache()
+
+	adminId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "role.deleted",
+		TargetType: "role",
+		TargetID:   name,
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// canGrant checks that the caller holds every permission they are handing out, roles
+// mustn't be a way to gain permissions. It writes the error response when they don't.
+func canGrant(w http.ResponseWriter, r *http.Request, permissions []string) bool {
+	held, _ := r.Context().Value(utils.Permissions).([]string)
+	missing := []string{}
+	for _, perm := range permissions {
+		if !slices.Contains(held, perm) {
+			missing = append(missing, perm)
+		}
+	}
+	if len(missing) > 0 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]any{"error": "cannot grant permissions you don't hold", "permissions": missing})
+		return false
+	}
+	return true
+}
+
+// validRole validates the role and that it only uses known permissions, writing the
+// error response when it doesn't.
+func validRole(w http.ResponseWriter, role *models.Role) bool {
+	if err := validate.Struct(role); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return false
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	for _, perm := range role.Permissions {
+		if !slices.Contains(models.AllPermissions, perm) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown permission " + perm})
+			return false
+		}
+	}
+	slices.Sort(role.Permissions)
+	role.Permissions = slices.Compact(role.Permissions)
+	return true
+}
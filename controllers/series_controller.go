@@ -0,0 +1,715 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var seriesCollection *mongo.Collection = database.OpenCollection("series")
+var episodeCollection *mongo.Collection = database.OpenCollection("episodes")
+
+// GetSeries lists the series the active profile may see, ?person_id= and ?role= narrow
+// it down to a person's series.
+func GetSeries(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	page, perPage := pagination(r)
+
+	filter := catalogFilter(profile, personFilter(r, bson.D{}))
+	total, err := seriesCollection.CountDocuments(r.Context(), filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch series"})
+		return
+	}
+	cursor, err := seriesCollection.Find(r.Context(), filter, options.Find().
+		SetSort(bson.D{bson.E{Key: "title", Value: 1}}).
+		SetSkip(int64((page-1)*perPage)).
+		SetLimit(int64(perPage)))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch series"})
+		return
+	}
+	series := []models.Series{}
+	if err := cursor.All(r.Context(), &series); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch series"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"series": series, "page": page, "per_page": perPage, "total": total})
+}
+
+// GetSeriesDetail returns the series with every season and its episodes, in order.
+func GetSeriesDetail(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	series, ok := loadSeries(w, r, catalogFilter(profile, bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}}))
+	if !ok {
+		return
+	}
+	episodes, err := seriesEpisodes(r, series.ImdbID, false)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch episodes"})
+		return
+	}
+
+	detail := models.SeriesDetail{Series: series, Seasons: []models.SeasonDetail{}}
+	for _, season := range series.Seasons {
+		seasonDetail := models.SeasonDetail{Season: season, Episodes: []models.Episode{}}
+		for _, episode := range episodes {
+			if episode.SeasonNumber == season.Number {
+				seasonDetail.Episodes = append(seasonDetail.Episodes, episode)
+			}
+		}
+		detail.Seasons = append(detail.Seasons, seasonDetail)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&detail)
+}
+
+// GetNextEpisode picks what the profile should play next from its watch history: the
+// first episode if it hasn't started the series, the last one it watched if it didn't
+// finish it, otherwise the one after. Specials and episodes that haven't aired are skipped.
+func GetNextEpisode(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	series, ok := loadSeries(w, r, catalogFilter(profile, bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}}))
+	if !ok {
+		return
+	}
+	episodes, err := seriesEpisodes(r, series.ImdbID, true)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch episodes"})
+		return
+	}
+
+	var last models.WatchHistoryEntry
+	err = watchHistoryCollection.FindOne(r.Context(), bson.D{
+		bson.E{Key: "profile_id", Value: profile.ProfileID},
+		bson.E{Key: "imdb_id", Value: series.ImdbID},
+		bson.E{Key: "season_number", Value: bson.D{bson.E{Key: "$gt", Value: 0}}},
+	}, options.FindOne().SetSort(bson.D{bson.E{Key: "watched_at", Value: -1}})).Decode(&last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load history"})
+		return
+	}
+
+	resp := map[string]any{"status": "finished", "episode": nil, "resume_from_seconds": 0}
+	switch {
+	case len(episodes) == 0:
+	case err == mongo.ErrNoDocuments:
+		resp["status"], resp["episode"] = "start", episodes[0]
+	default:
+		// the episode may be gone, the position in the order still tells where to go on
+		i, found := slices.BinarySearchFunc(episodes, last, func(e models.Episode, last models.WatchHistoryEntry) int {
+			if e.SeasonNumber != last.SeasonNumber {
+				return e.SeasonNumber - last.SeasonNumber
+			}
+			return e.EpisodeNumber - last.EpisodeNumber
+		})
+		if found && !last.Completed {
+			resp["status"], resp["episode"], resp["resume_from_seconds"] = "resume", episodes[i], last.PositionSeconds
+		} else {
+			if found {
+				i++
+			}
+			if i < len(episodes) {
+				resp["status"], resp["episode"] = "next", episodes[i]
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func CreateSeries(w http.ResponseWriter, r *http.Request) {
+	var series models.Series
+	if err := json.NewDecoder(r.Body).Decode(&series); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(series); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	if series.Seasons == nil {
+		series.Seasons = []models.Season{}
+	}
+	slices.SortFunc(series.Seasons, func(a, b models.Season) int { return a.Number - b.Number })
+	for i := 1; i < len(series.Seasons); i++ {
+		if series.Seasons[i].Number == series.Seasons[i-1].Number {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "duplicate season number"})
+			return
+		}
+	}
+	if !validCatalogEntry(w, r, series.Genre, series.Maturity) || !validCredits(w, r, series.Credits) {
+		return
+	}
+
+	// movies and series share the imdb id space
+	count, err := movieCollection.CountDocuments(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: series.ImdbID}})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while inserting series"})
+		return
+	}
+	if count > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a title with this imdb id already exists"})
+		return
+	}
+
+	series.ID = primitive.NilObjectID
+	series.CreatedAt = time.Now()
+	series.UpdatedAt = series.CreatedAt
+	_, err = seriesCollection.InsertOne(r.Context(), series)
+	if mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a title with this imdb id already exists"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while inserting series"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "series.created",
+		TargetType: "series",
+		TargetID:   series.ImdbID,
+		After:      seriesAuditState(series),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&series)
+}
+
+// UpdateSeries changes the series itself, fields left out of the body are kept. Seasons
+// and episodes have their own endpoints.
+func UpdateSeries(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Title      *string                `json:"title" validate:"omitempty,min=2,max=500"`
+		Overview   *string                `json:"overview" validate:"omitempty,max=5000"`
+		PosterPath *string                `json:"poster_path" validate:"omitempty,url"`
+		YoutubeID  *string                `json:"youtube_id"`
+		Genre      []models.Genre         `json:"genres" validate:"omitempty,min=1,dive"`
+		Maturity   *models.MaturityRating `json:"maturity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	if !validCatalogEntry(w, r, req.Genre, req.Maturity) {
+		return
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: time.Now()}}
+	if req.Title != nil {
+		set = append(set, bson.E{Key: "title", Value: *req.Title})
+	}
+	if req.Overview != nil {
+		set = append(set, bson.E{Key: "overview", Value: *req.Overview})
+	}
+	if req.PosterPath != nil {
+		set = append(set, bson.E{Key: "poster_path", Value: *req.PosterPath})
+	}
+	if req.YoutubeID != nil {
+		set = append(set, bson.E{Key: "youtube_id", Value: *req.YoutubeID})
+	}
+	if req.Genre != nil {
+		set = append(set, bson.E{Key: "genres", Value: req.Genre})
+	}
+	if req.Maturity != nil {
+		set = append(set, bson.E{Key: "maturity", Value: req.Maturity})
+	}
+
+	var before models.Series
+	err := seriesCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	}).Decode(&before)
+	if !seriesUpdated(w, err) {
+		return
+	}
+	series, ok := loadSeries(w, r, bson.D{bson.E{Key: "imdb_id", Value: before.ImdbID}})
+	if !ok {
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "series.updated",
+		TargetType: "series",
+		TargetID:   series.ImdbID,
+		Before:     seriesAuditState(before),
+		After:      seriesAuditState(series),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&series)
+}
+
+// DeleteSeries removes the series and all its episodes.
+func DeleteSeries(w http.ResponseWriter, r *http.Request) {
+	var before models.Series
+	err := seriesCollection.FindOneAndDelete(r.Context(), bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}}).Decode(&before)
+	if !seriesUpdated(w, err) {
+		return
+	}
+	if _, err := episodeCollection.DeleteMany(r.Context(), bson.D{bson.E{Key: "series_id", Value: before.ImdbID}}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete episodes"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "series.deleted",
+		TargetType: "series",
+		TargetID:   before.ImdbID,
+		Before:     seriesAuditState(before),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// PutSeason adds the season with the number in the path or replaces it.
+func PutSeason(w http.ResponseWriter, r *http.Request) {
+	number, ok := seasonNumber(w, r)
+	if !ok {
+		return
+	}
+	var season models.Season
+	if err := json.NewDecoder(r.Body).Decode(&season); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	season.Number = number
+	if err := validate.Struct(season); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	series, ok := loadSeries(w, r, bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}})
+	if !ok {
+		return
+	}
+	seasons := slices.DeleteFunc(slices.Clone(series.Seasons), func(s models.Season) bool { return s.Number == number })
+	seasons = append(seasons, season)
+	slices.SortFunc(seasons, func(a, b models.Season) int { return a.Number - b.Number })
+	if !replaceSeasons(w, r, series, seasons) {
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "series.season_saved",
+		TargetType: "series",
+		TargetID:   series.ImdbID,
+		Details:    map[string]any{"season": number},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&season)
+}
+
+// DeleteSeason removes the season and its episodes.
+func DeleteSeason(w http.ResponseWriter, r *http.Request) {
+	number, ok := seasonNumber(w, r)
+	if !ok {
+		return
+	}
+	series, ok := loadSeries(w, r, bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}})
+	if !ok {
+		return
+	}
+	seasons := slices.DeleteFunc(slices.Clone(series.Seasons), func(s models.Season) bool { return s.Number == number })
+	if len(seasons) == len(series.Seasons) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Season not found"})
+		return
+	}
+	if !replaceSeasons(w, r, series, seasons) {
+		return
+	}
+	_, err := episodeCollection.DeleteMany(r.Context(), bson.D{
+		bson.E{Key: "series_id", Value: series.ImdbID},
+		bson.E{Key: "season_number", Value: number},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete episodes"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "series.season_deleted",
+		TargetType: "series",
+		TargetID:   series.ImdbID,
+		Details:    map[string]any{"season": number},
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// CreateEpisode adds an episode to an existing season, episode numbers are unique per season.
+func CreateEpisode(w http.ResponseWriter, r *http.Request) {
+	number, ok := seasonNumber(w, r)
+	if !ok {
+		return
+	}
+	var episode models.Episode
+	if err := json.NewDecoder(r.Body).Decode(&episode); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(episode); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	series, ok := loadSeries(w, r, bson.D{bson.E{Key: "imdb_id", Value: r.PathValue("series_id")}})
+	if !ok {
+		return
+	}
+	if !slices.ContainsFunc(series.Seasons, func(s models.Season) bool { return s.Number == number }) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Season not found"})
+		return
+	}
+
+	episode.ID = primitive.NilObjectID
+	episode.EpisodeID = primitive.NewObjectID().Hex()
+	episode.SeriesID = series.ImdbID
+	episode.SeasonNumber = number
+	if episode.Media == nil {
+		episode.Media = []models.MediaRef{}
+	}
+	episode.CreatedAt = time.Now()
+	episode.UpdatedAt = episode.CreatedAt
+	_, err := episodeCollection.InsertOne(r.Context(), episode)
+	if mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "episode number already taken in this season"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error while inserting episode"})
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "episode.created",
+		TargetType: "episode",
+		TargetID:   episode.EpisodeID,
+		After:      episodeAuditState(episode),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&episode)
+}
+
+// UpdateEpisode changes an episode, fields left out of the body are kept.
+func UpdateEpisode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		EpisodeNumber  *int              `json:"episode_number" validate:"omitempty,min=1"`
+		Title          *string           `json:"title" validate:"omitempty,min=1,max=500"`
+		Overview       *string           `json:"overview" validate:"omitempty,max=5000"`
+		AirDate        *time.Time        `json:"air_date"`
+		RuntimeMinutes *int              `json:"runtime_minutes" validate:"omitempty,min=0"`
+		Media          []models.MediaRef `json:"media" validate:"omitempty,dive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+
+	set := bson.D{bson.E{Key: "updated_at", Value: time.Now()}}
+	if req.EpisodeNumber != nil {
+		set = append(set, bson.E{Key: "episode_number", Value: *req.EpisodeNumber})
+	}
+	if req.Title != nil {
+		set = append(set, bson.E{Key: "title", Value: *req.Title})
+	}
+	if req.Overview != nil {
+		set = append(set, bson.E{Key: "overview", Value: *req.Overview})
+	}
+	if req.AirDate != nil {
+		set = append(set, bson.E{Key: "air_date", Value: *req.AirDate})
+	}
+	if req.RuntimeMinutes != nil {
+		set = append(set, bson.E{Key: "runtime_minutes", Value: *req.RuntimeMinutes})
+	}
+	if req.Media != nil {
+		set = append(set, bson.E{Key: "media", Value: req.Media})
+	}
+
+	var episode models.Episode
+	err := episodeCollection.FindOneAndUpdate(r.Context(), bson.D{bson.E{Key: "episode_id", Value: r.PathValue("episode_id")}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&episode)
+	if mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "episode number already taken in this season"})
+		return
+	}
+	if !episodeUpdated(w, err) {
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "episode.updated",
+		TargetType: "episode",
+		TargetID:   episode.EpisodeID,
+		After:      episodeAuditState(episode),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&episode)
+}
+
+func DeleteEpisode(w http.ResponseWriter, r *http.Request) {
+	var before models.Episode
+	err := episodeCollection.FindOneAndDelete(r.Context(), bson.D{bson.E{Key: "episode_id", Value: r.PathValue("episode_id")}}).Decode(&before)
+	if !episodeUpdated(w, err) {
+		return
+	}
+
+	userId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    userId,
+		Action:     "episode.deleted",
+		TargetType: "episode",
+		TargetID:   before.EpisodeID,
+		Before:     episodeAuditState(before),
+		IP:         utils.ClientIP(r),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+func loadSeries(w http.ResponseWriter, r *http.Request, filter bson.D) (models.Series, bool) {
+	var series models.Series
+	err := seriesCollection.FindOne(r.Context(), filter).Decode(&series)
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Series not found"})
+		return series, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch series"})
+		return series, false
+	}
+	return series, true
+}
+
+// seriesEpisodes returns the episodes of a series in watching order. With airedOnly
+// specials (season 0) and episodes that haven't aired are left out.
+func seriesEpisodes(r *http.Request, seriesId string, airedOnly bool) ([]models.Episode, error) {
+	filter := bson.D{bson.E{Key: "series_id", Value: seriesId}}
+	if airedOnly {
+		filter = append(filter,
+			bson.E{Key: "season_number", Value: bson.D{bson.E{Key: "$gt", Value: 0}}},
+			bson.E{Key: "$or", Value: bson.A{
+				bson.D{bson.E{Key: "air_date", Value: bson.D{bson.E{Key: "$exists", Value: false}}}},
+				bson.D{bson.E{Key: "air_date", Value: bson.D{bson.E{Key: "$lte", Value: time.Now()}}}},
+			}},
+		)
+	}
+	cursor, err := episodeCollection.Find(r.Context(), filter, options.Find().SetSort(bson.D{
+		bson.E{Key: "season_number", Value: 1},
+		bson.E{Key: "episode_number", Value: 1},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	episodes := []models.Episode{}
+	err = cursor.All(r.Context(), &episodes)
+	return episodes, err
+}
+
+// replaceSeasons writes the seasons back unless the series changed since it was loaded,
+// two admins editing seasons at once would otherwise lose one of the edits.
+func replaceSeasons(w http.ResponseWriter, r *http.Request, series models.Series, seasons []models.Season) bool {
+	result, err := seriesCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "imdb_id", Value: series.ImdbID},
+		bson.E{Key: "updated_at", Value: series.UpdatedAt},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "seasons", Value: seasons},
+			bson.E{Key: "updated_at", Value: time.Now()},
+		}},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update seasons"})
+		return false
+	}
+	if result.MatchedCount == 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "series was changed at the same time, try again"})
+		return false
+	}
+	return true
+}
+
+func seasonNumber(w http.ResponseWriter, r *http.Request) (int, bool) {
+	number, err := strconv.Atoi(r.PathValue("season_number"))
+	if err != nil || number < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid season number"})
+		return 0, false
+	}
+	return number, true
+}
+
+// validCatalogEntry checks the genres and normalizes the maturity rating of a title,
+// both may be nil.
+func validCatalogEntry(w http.ResponseWriter, r *http.Request, genres []models.Genre, maturity *models.MaturityRating) bool {
+	if maturity != nil {
+		if err := validate.Struct(maturity); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "system and rating are required"})
+			return false
+		}
+		if err := utils.NormalizeMaturity(maturity); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return false
+		}
+	}
+	if err := validateGenres(r.Context(), genres); err != nil {
+		if errors.Is(err, errUnknownGenre) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to check genres"})
+		return false
+	}
+	return true
+}
+
+func seriesUpdated(w http.ResponseWriter, err error) bool {
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Series not found"})
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error updating series"})
+		return false
+	}
+	return true
+}
+
+func episodeUpdated(w http.ResponseWriter, err error) bool {
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Episode not found"})
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "error updating episode"})
+		return false
+	}
+	return true
+}
+
+func seriesAuditState(series models.Series) map[string]any {
+	genres := []string{}
+	for _, genre := range series.Genre {
+		genres = append(genres, genre.GenreName)
+	}
+	return map[string]any{
+		"title":       series.Title,
+		"poster_path": series.PosterPath,
+		"youtube_id":  series.YoutubeID,
+		"genres":      genres,
+		"seasons":     len(series.Seasons),
+		"maturity":    series.Maturity,
+	}
+}
+
+func episodeAuditState(episode models.Episode) map[string]any {
+	return map[string]any{
+		"series_id":       episode.SeriesID,
+		"season_number":   episode.SeasonNumber,
+		"episode_number":  episode.EpisodeNumber,
+		"title":           episode.Title,
+		"air_date":        episode.AirDate,
+		"runtime_minutes": episode.RuntimeMinutes,
+		"media":           len(episode.Media),
+	}
+}
@@ -1,9 +1,14 @@
 package controllers
 
 import (
-	"context"
 	"encoding/json"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Chandra5468/movie-streaming/database"
@@ -13,30 +18,35 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var userCollection *mongo.Collection = database.OpenCollection("users")
 
-func HashPassword(password string) (string, error) {
-	HashPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-
-	return string(HashPassword), nil
-}
+// dummyPasswordHash is compared against when the email doesn't exist so the response time
+// doesn't tell whether an account is registered.
+var dummyPasswordHash, _ = utils.HashPassword("not-a-real-password")
 
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
-	var user models.User
+	var input models.User
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewDecoder(r.Body).Decode(&user)
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
 		return
 	}
 
+	// only copy what a client may choose, role, status, 2fa and linked identities are
+	// set by the server. Roles are only handed out by admins.
+	user := models.User{
+		FirstName:       input.FirstName,
+		LastName:        input.LastName,
+		Email:           input.Email,
+		Password:        input.Password,
+		FavouriteGenres: input.FavouriteGenres,
+		Roles:           []string{models.RoleUser},
+	}
+
 	validate := validator.New()
 
 	if err := validate.Struct(user); err != nil {
@@ -45,7 +55,13 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashedPwd, err := HashPassword(user.Password)
+	if problems := utils.DefaultPasswordPolicy.Check(user.Password, user.Email, user.FirstName, user.LastName); len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "password does not meet the password policy", "details": problems})
+		return
+	}
+
+	hashedPwd, err := utils.HashPassword(user.Password)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -76,6 +92,8 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 	user.Password = hashedPwd
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
+	user.Status = models.UserStatusUnverified
+	user.EmailVerifiedAt = nil
 
 	_, err = userCollection.InsertOne(r.Context(), user)
 
@@ -85,6 +103,11 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the account exists either way, the user can ask for a new link if this one got lost
+	if err := sendVerificationEmail(r.Context(), user); err != nil {
+		log.Printf("failed to send verification email to %s: %v", user.UserID, err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "successful"})
 }
@@ -97,6 +120,10 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if loginThrottled(w, r, userLogin.Email) {
+		return
+	}
+
 	var foundUser models.User
 	err := userCollection.FindOne(r.Context(), bson.D{
 		bson.E{
@@ -106,118 +133,275 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 	}).Decode(&foundUser)
 
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email or password"})
+		// compare against a dummy hash so an unknown email takes as long as a wrong password
+		utils.VerifyPassword(dummyPasswordHash, userLogin.Password)
+		loginFailed(w, r, userLogin.Email)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.Password), []byte(userLogin.Password))
+	match, needsRehash, err := utils.VerifyPassword(foundUser.Password, userLogin.Password)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid password"})
+		log.Printf("failed to verify password for %s: %v", foundUser.UserID, err)
+	}
+	if !match {
+		loginFailed(w, r, userLogin.Email)
 		return
 	}
 
-	token, refreshToken, err := utils.GenerateAllTokens(foundUser.Email, foundUser.FirstName, foundUser.LastName, foundUser.Role, foundUser.UserID)
+	// upgrade old bcrypt hashes / outdated parameters now that we have the plain password
+	if needsRehash {
+		if newHash, err := utils.HashPassword(userLogin.Password); err == nil {
+			_, err = userCollection.UpdateOne(r.Context(), bson.D{
+				bson.E{Key: "user_id", Value: foundUser.UserID},
+			}, bson.D{
+				bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password", Value: newHash}}},
+			})
+			if err != nil {
+				log.Printf("failed to rehash password for %s: %v", foundUser.UserID, err)
+			}
+		}
+	}
 
+	// second step happens in LoginWithTOTP, failures aren't reset until then
+	if foundUser.TOTPEnabled {
+		requireMFA(w, foundUser)
+		return
+	}
+
+	completeLogin(w, r, foundUser, userLogin.ReturnTokens, utils.WithLogin(utils.LoginMethodPassword))
+}
+
+// requireMFA ends the first login step of an account with 2fa on. The client finishes
+// the login with the mfa_token at LoginWithTOTP.
+func requireMFA(w http.ResponseWriter, user models.User) {
+	mfaToken, err := utils.GeneratePurposeToken(utils.MFAChallengeTokenType, user.UserID, user.Email, mfaChallengeTTL)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate token"})
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"mfa_required": true, "mfa_token": mfaToken})
+}
 
-	err = utils.UpdateAllTokens(foundUser.UserID, token, refreshToken)
+// redirectToMFA is requireMFA for logins that end in a browser redirect. The mfa token
+// goes in the fragment so it never reaches a server log.
+func redirectToMFA(w http.ResponseWriter, r *http.Request, user models.User, redirectURL string) {
+	mfaToken, err := utils.GeneratePurposeToken(utils.MFAChallengeTokenType, user.UserID, user.Email, mfaChallengeTTL)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update tokens"})
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate token"})
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   86400,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode, // why to choose this one
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		Path:     "/",
-		MaxAge:   604800,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode,
-	})
+	http.Redirect(w, r, redirectURL+"#mfa_token="+url.QueryEscape(mfaToken), http.StatusFound)
+}
+
+// completeLogin issues the session for a user that passed every authentication step.
+// Every login flow ends here so cookies, csrf and the response body look the same.
+func completeLogin(w http.ResponseWriter, r *http.Request, user models.User, returnTokens bool, opts ...utils.TokenOption) {
+	permissions, err := utils.ResolvePermissions(r.Context(), user.Roles)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load permissions"})
+		return
+	}
+
+	token, refreshToken, ok := startSession(w, r, user, opts...)
+	if !ok {
+		return
+	}
+	resp := models.UserResponse{
+		UserId:          user.UserID,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		Email:           user.Email,
+		Roles:           user.Roles,
+		Permissions:     permissions,
+		FavouriteGenres: user.FavouriteGenres,
+		EmailVerified:   user.IsEmailVerified(),
+		// lets the frontend send admins to 2fa setup before they hit a blocked route
+		MFAEnrollmentRequired: utils.RequireAdminMFA && slices.Contains(user.Roles, models.RoleAdmin) && !user.TOTPEnabled,
+	}
+	if returnTokens || isNonBrowserClient(r) {
+		resp.Token = token
+		resp.RefreshToken = refreshToken
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(models.UserResponse{
-		UserId:    foundUser.UserID,
-		FirstName: foundUser.FirstName,
-		LastName:  foundUser.LastName,
-		Email:     foundUser.Email,
-		Role:      foundUser.Role,
-		// Token:           token,
-		// RefreshToken:    refreshToken,
-		FavouriteGenres: foundUser.FavouriteGenres,
-	})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// startSession generates and stores the tokens and sets the session cookies. It writes
+// the error response itself, callers only need to stop when ok is false. Signing in
+// during the grace period of DELETE /api/me cancels the deletion.
+func startSession(w http.ResponseWriter, r *http.Request, user models.User, opts ...utils.TokenOption) (token, refreshToken string, ok bool) {
+	if user.DisabledAt != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Account has been disabled"})
+		return "", "", false
+	}
+	if err := utils.ResetLoginFailures(r.Context(), user.Email); err != nil {
+		log.Printf("failed to reset login attempts: %v", err)
+	}
+	if user.DeletionScheduledAt != nil {
+		cancelAccountDeletion(r, user)
+	}
 
+	token, refreshToken, err := utils.GenerateAllTokens(user, opts...)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate token"})
+		return "", "", false
+	}
+
+	err = utils.UpdateAllTokens(r.Context(), user.UserID, token, refreshToken)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update tokens"})
+		return "", "", false
+	}
+	if err := setSessionCookies(w, token, refreshToken); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue csrf token"})
+		return "", "", false
+	}
+	return token, refreshToken, true
 }
 
-func LogoutUser(w http.ResponseWriter, r *http.Request) {
-	var UserLogout struct {
-		UserId string `json:"user_id"`
+// loginThrottled answers 429 while email has to wait after failed attempts.
+func loginThrottled(w http.ResponseWriter, r *http.Request, email string) bool {
+	retryAfter, err := utils.CheckLoginAllowed(r.Context(), email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to check login attempts"})
+		return true
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many failed login attempts, try again later"})
+		return true
 	}
+	return false
+}
 
-	err := json.NewDecoder(r.Body).Decode(&UserLogout)
+// loginFailed counts the failure and sends the same response for unknown emails and wrong passwords.
+func loginFailed(w http.ResponseWriter, r *http.Request, email string) {
+	recordLoginFailure(r, email)
 
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email or password"})
+}
+
+// recordLoginFailure counts a wrong password or code and audits the lockout it may cause.
+func recordLoginFailure(r *http.Request, email string) {
+	locked, err := utils.RecordLoginFailure(r.Context(), email)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		log.Printf("failed to record login attempt: %v", err)
+	}
+	if !locked {
 		return
 	}
 
-	err = utils.UpdateAllTokens(UserLogout.UserId, "", "")
+	// the event has to be found by the user's exports and erasure, so a known account is
+	// recorded by its id and an unknown address only by its hash
+	event := models.AuditEvent{
+		Action:     "account.locked",
+		TargetType: "email",
+		TargetID:   utils.AuditEmailTarget(email),
+		IP:         utils.ClientIP(r),
+	}
+	var user models.User
+	err = userCollection.FindOne(r.Context(), bson.D{bson.E{Key: "email", Value: email}}).Decode(&user)
+	if err == nil {
+		event.TargetType = "user"
+		event.TargetID = user.UserID
+	} else if err != mongo.ErrNoDocuments {
+		log.Printf("failed to look up locked account: %v", err)
+	}
+	utils.RecordAuditEvent(r.Context(), event)
+}
+
+// UnlockUser clears the lockout and failed attempts of a user (admin only).
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("user_id")
+
+	var user models.User
+	err := userCollection.FindOne(r.Context(), bson.D{
+		bson.E{
+			Key:   "user_id",
+			Value: userId,
+		},
+	}).Decode(&user)
+
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1, // negative max age will delete token
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode,
-	})
+	if err := utils.ResetLoginFailures(r.Context(), user.Email); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to unlock user"})
+		return
+	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteNoneMode,
+	adminId, _ := utils.GetDataFromContext(r)
+	utils.RecordAuditEvent(r.Context(), models.AuditEvent{
+		ActorID:    adminId,
+		Action:     "account.unlocked",
+		TargetType: "user",
+		TargetID:   user.UserID,
+		IP:         utils.ClientIP(r),
 	})
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
 }
 
-func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 100*time.Second)
-	defer cancel()
+func LogoutUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.GetDataFromContext(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user id not found in context"})
+		return
+	}
 
-	refreshTokenVar, err := r.Cookie("refresh_token")
-	refreshToken := refreshTokenVar.Value
+	err = utils.UpdateAllTokens(r.Context(), userId, "", "")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unable to retrieve refresh token from cookie"})
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to clear tokens"})
 		return
 	}
 
+	clearSessionCookies(w)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// browsers send the cookie, cli/mobile clients post the refresh token in the body
+	var refreshToken string
+	fromBody := false
+	if refreshTokenVar, err := r.Cookie("refresh_token"); err == nil && refreshTokenVar.Value != "" {
+		refreshToken = refreshTokenVar.Value
+	} else {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unable to retrieve refresh token"})
+			return
+		}
+		refreshToken = body.RefreshToken
+		fromBody = true
+	}
+
 	claim, err := utils.ValidateRefreshToken(refreshToken)
 
 	if err != nil {
@@ -239,35 +423,78 @@ func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newToken, newRefreshToken, _ := utils.GenerateAllTokens(user.Email, user.FirstName, user.LastName, user.Role, user.UserID)
-	err = utils.UpdateAllTokens(user.UserID, newToken, newRefreshToken)
+	if user.DisabledAt != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Account has been disabled"})
+		return
+	}
+
+	// iat only has second precision
+	if user.SessionsRevokedAt != nil && claim.IssuedAt.Time.Before(user.SessionsRevokedAt.Truncate(time.Second)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session has been revoked"})
+		return
+	}
+
+	newToken, newRefreshToken, _ := utils.GenerateAllTokens(user, utils.WithMFA(claim.MFA), utils.WithProfile(claim.ProfileID), utils.WithLoginAt(claim.LoginMethod, claim.AuthTime))
+	err = utils.UpdateAllTokens(ctx, user.UserID, newToken, newRefreshToken)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating tokens"})
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:   "access_token",
-		Value:  newToken,
-		MaxAge: 86400, // expires in 24 hrs
-		Path:   "/",
-		// Domain: ,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-		HttpOnly: true,
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:   "refresh_token",
-		Value:  newRefreshToken,
-		MaxAge: 604800, // expires in 1 week
-		Path:   "/",
-		// Domain: ,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-		HttpOnly: true,
-	})
+	if err := setSessionCookies(w, newToken, newRefreshToken); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue csrf token"})
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
+	if fromBody || isNonBrowserClient(r) {
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "token": newToken, "refresh_token": newRefreshToken})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
+
+// GetCSRFToken hands out a fresh csrf token for the session cookie sent along, the
+// frontend calls it on load when it has no csrf cookie yet (login already sets one).
+func GetCSRFToken(w http.ResponseWriter, r *http.Request) {
+	var session string
+	if cookie, err := r.Cookie("access_token"); err == nil {
+		session = cookie.Value
+	}
+	token, err := utils.IssueCSRFToken(w, session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue csrf token"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"csrf_token": token})
+}
+
+// isNonBrowserClient is true for clients that identify themselves with X-Client-Type: cli|mobile.
+func isNonBrowserClient(r *http.Request) bool {
+	switch strings.ToLower(r.Header.Get("X-Client-Type")) {
+	case "cli", "mobile":
+		return true
+	}
+	return false
+}
+
+func setSessionCookies(w http.ResponseWriter, token, refreshToken string) error {
+	utils.SetCookie(w, "access_token", token, 86400, true)          // expires in 24 hrs
+	utils.SetCookie(w, "refresh_token", refreshToken, 604800, true) // expires in 1 week
+	_, err := utils.IssueCSRFToken(w, token)
+	return err
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	// negative max age will delete the cookie
+	utils.SetCookie(w, "access_token", "", -1, true)
+	utils.SetCookie(w, "refresh_token", "", -1, true)
+	utils.SetCookie(w, utils.CSRFCookieName, "", -1, false)
+}
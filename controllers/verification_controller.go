@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/mailer"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	verificationTokenTTL = utils.GetEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	// the frontend page that posts the token to /api/verify-email
+	verifyEmailURL = utils.GetEnvString("VERIFY_EMAIL_URL", "http://localhost:3000/verify-email")
+	// at most VERIFICATION_RESEND_MAX_PER_WINDOW resends per email every VERIFICATION_RESEND_WINDOW (up to a day)
+	verificationResendMaxPerWindow = utils.GetEnvInt("VERIFICATION_RESEND_MAX_PER_WINDOW", 3)
+	verificationResendWindow       = utils.GetEnvDuration("VERIFICATION_RESEND_WINDOW", time.Hour)
+)
+
+func sendVerificationEmail(ctx context.Context, user models.User) error {
+	token, err := utils.GeneratePurposeToken(utils.EmailVerificationTokenType, user.UserID, user.Email, verificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := verifyEmailURL + "?token=" + url.QueryEscape(token)
+	return mailer.Default.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"Confirm your email address by opening the link below. It expires in " + verificationTokenTTL.String() + ".\n\n" +
+			link + "\n",
+	})
+}
+
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token required"})
+		return
+	}
+
+	claims, err := utils.ValidatePurposeToken(req.Token, utils.EmailVerificationTokenType)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired verification link"})
+		return
+	}
+
+	now := time.Now()
+	// matching on the email too means a link sent before an email change can't verify the new address
+	result, err := userCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "user_id", Value: claims.UserId},
+		bson.E{Key: "email", Value: claims.Email},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "status", Value: models.UserStatusActive},
+			bson.E{Key: "email_verified_at", Value: now},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	})
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to verify email"})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired verification link"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"verified": true})
+}
+
+// ResendVerificationEmail always answers the same way, whether the email is registered,
+// rate limited or the send failed, so it can't be used to find registered emails.
+func ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email required"})
+		return
+	}
+
+	go func(email string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := resendVerificationEmail(ctx, email); err != nil {
+			log.Printf("failed to resend verification email: %v", err)
+		}
+	}(req.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the address belongs to an unverified account a new link has been sent"})
+}
+
+func resendVerificationEmail(ctx context.Context, email string) error {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{
+		bson.E{Key: "email", Value: email},
+		bson.E{Key: "status", Value: models.UserStatusUnverified},
+	}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// counted before sending so failed sends can't be retried without limit
+	allowed, err := utils.AllowEmail(ctx, utils.EmailKindVerification, user.Email, verificationResendMaxPerWindow, verificationResendWindow)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.Printf("verification email for %s not resent, rate limit reached", user.UserID)
+		return nil
+	}
+	return sendVerificationEmail(ctx, user)
+}
@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The watchlist and history hold titles (movies and series) and belong to the active
+// profile, see custommiddleware.ActiveProfile.
+var watchlistCollection *mongo.Collection = database.OpenCollection("watchlist")
+var watchHistoryCollection *mongo.Collection = database.OpenCollection("watch_history")
+
+// GetWatchlist lists the watchlist newest first, paginated like the history. Titles the
+// profile can't see (blocked, or above its maturity level) are left out.
+func GetWatchlist(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	page, perPage := pagination(r)
+
+	items := []models.WatchlistItem{}
+	total, err := visibleEntries(r.Context(), watchlistCollection, profile, bson.D{bson.E{Key: "added_at", Value: -1}}, page, perPage, &items)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load watchlist"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"items": items, "page": page, "per_page": perPage, "total": total})
+}
+
+// AddToWatchlist puts the movie or series on the watchlist, adding it twice is a no-op.
+func AddToWatchlist(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	imdbId := r.PathValue("imdb_id")
+	title, ok := visibleTitle(w, r, profile, imdbId)
+	if !ok {
+		return
+	}
+
+	_, err := watchlistCollection.UpdateOne(r.Context(), bson.D{
+		bson.E{Key: "profile_id", Value: profile.ProfileID},
+		bson.E{Key: "imdb_id", Value: imdbId},
+	}, bson.D{
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "user_id", Value: profile.UserID},
+			bson.E{Key: "title_type", Value: title.TitleType()},
+			bson.E{Key: "added_at", Value: time.Now()},
+		}},
+	}, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update watchlist"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+func RemoveFromWatchlist(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := watchlistCollection.DeleteOne(r.Context(), bson.D{
+		bson.E{Key: "profile_id", Value: profile.ProfileID},
+		bson.E{Key: "imdb_id", Value: r.PathValue("imdb_id")},
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update watchlist"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// GetWatchHistory lists what the profile watched, most recent first.
+func GetWatchHistory(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+	page, perPage := pagination(r)
+
+	entries := []models.WatchHistoryEntry{}
+	total, err := visibleEntries(r.Context(), watchHistoryCollection, profile, bson.D{bson.E{Key: "watched_at", Value: -1}}, page, perPage, &entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to load history"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"history": entries, "page": page, "per_page": perPage, "total": total})
+}
+
+// RecordWatchProgress stores how far the profile got in a movie or an episode, players
+// call it periodically and when playback stops. Episodes need episode_id, imdb_id is
+// their series.
+func RecordWatchProgress(w http.ResponseWriter, r *http.Request) {
+	profile, ok := activeProfile(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ImdbID          string `json:"imdb_id" validate:"required"`
+		EpisodeID       string `json:"episode_id"`
+		PositionSeconds int    `json:"position_seconds" validate:"min=0"`
+		Completed       bool   `json:"completed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid input"})
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "validation failed"})
+		return
+	}
+	title, ok := visibleTitle(w, r, profile, req.ImdbID)
+	if !ok {
+		return
+	}
+
+	set := bson.D{
+		bson.E{Key: "user_id", Value: profile.UserID},
+		bson.E{Key: "title_type", Value: title.TitleType()},
+	}
+	switch {
+	case title.TitleType() == models.TitleTypeSeries && req.EpisodeID == "":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "episode_id is required for a series"})
+		return
+	case title.TitleType() == models.TitleTypeSeries:
+		var episode models.Episode
+		err := episodeCollection.FindOne(r.Context(), bson.D{
+			bson.E{Key: "episode_id", Value: req.EpisodeID},
+			bson.E{Key: "series_id", Value: req.ImdbID},
+		}).Decode(&episode)
+		if err == mongo.ErrNoDocuments {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Episode not found"})
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "failed to load episode"})
+			return
+		}
+		set = append(set,
+			bson.E{Key: "season_number", Value: episode.SeasonNumber},
+			bson.E{Key: "episode_number", Value: episode.EpisodeNumber},
+		)
+	case req.EpisodeID != "":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "movies have no episodes"})
+		return
+	}
+
+	filter := bson.D{
+		bson.E{Key: "profile_id", Value: profile.ProfileID},
+		bson.E{Key: "imdb_id", Value: req.ImdbID},
+		bson.E{Key: "episode_id", Value: req.EpisodeID},
+	}
+	update := bson.D{
+		bson.E{Key: "$set", Value: append(set,
+			bson.E{Key: "position_seconds", Value: req.PositionSeconds},
+			bson.E{Key: "completed", Value: req.Completed},
+			bson.E{Key: "watched_at", Value: time.Now()},
+		)},
+	}
+	_, err := watchHistoryCollection.UpdateOne(r.Context(), filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent report inserted the entry first, this one updates it instead
+		_, err = watchHistoryCollection.UpdateOne(r.Context(), filter, update, options.Update().SetUpsert(true))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to record progress"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"successful": true})
+}
+
+// visibleEntries decodes one page of the profile's entries in collection into out and
+// returns how many there are. Entries are kept only while their title passes
+// catalogFilter, so a title blocked or re-rated later drops out of the list.
+func visibleEntries(ctx context.Context, collection *mongo.Collection, profile models.Profile, sort bson.D, page, perPage int, out any) (int64, error) {
+	visible := func(from, as string) bson.D {
+		return bson.D{bson.E{Key: "$lookup", Value: bson.D{
+			bson.E{Key: "from", Value: from},
+			bson.E{Key: "let", Value: bson.D{bson.E{Key: "imdb_id", Value: "$imdb_id"}}},
+			bson.E{Key: "pipeline", Value: bson.A{
+				bson.D{bson.E{Key: "$match", Value: bson.D{bson.E{Key: "$expr", Value: bson.D{
+					bson.E{Key: "$eq", Value: bson.A{"$imdb_id", "$$imdb_id"}},
+				}}}}},
+				bson.D{bson.E{Key: "$match", Value: catalogFilter(profile, bson.D{})}},
+				bson.D{bson.E{Key: "$project", Value: bson.D{bson.E{Key: "_id", Value: 1}}}},
+			}},
+			bson.E{Key: "as", Value: as},
+		}}}
+	}
+	pipeline := mongo.Pipeline{
+		bson.D{bson.E{Key: "$match", Value: bson.D{bson.E{Key: "profile_id", Value: profile.ProfileID}}}},
+		visible(movieCollection.Name(), "visible_movie"),
+		visible(seriesCollection.Name(), "visible_series"),
+		bson.D{bson.E{Key: "$match", Value: bson.D{bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "visible_movie", Value: bson.D{bson.E{Key: "$ne", Value: bson.A{}}}}},
+			bson.D{bson.E{Key: "visible_series", Value: bson.D{bson.E{Key: "$ne", Value: bson.A{}}}}},
+		}}}}},
+		bson.D{bson.E{Key: "$unset", Value: bson.A{"visible_movie", "visible_series"}}},
+		bson.D{bson.E{Key: "$sort", Value: sort}},
+		bson.D{bson.E{Key: "$facet", Value: bson.D{
+			bson.E{Key: "items", Value: bson.A{
+				bson.D{bson.E{Key: "$skip", Value: int64((page - 1) * perPage)}},
+				bson.D{bson.E{Key: "$limit", Value: int64(perPage)}},
+			}},
+			bson.E{Key: "total", Value: bson.A{bson.D{bson.E{Key: "$count", Value: "count"}}}},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var result struct {
+		Items bson.RawValue `bson:"items"`
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+	}
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return 0, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, err
+	}
+	if len(result.Total) == 0 {
+		return 0, nil
+	}
+	return result.Total[0].Count, result.Items.Unmarshal(out)
+}
+
+// activeProfile reads the profile set by the ActiveProfile middleware.
+func activeProfile(w http.ResponseWriter, r *http.Request) (models.Profile, bool) {
+	profile, ok := utils.ProfileFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "profile not found in context"})
+	}
+	return profile, ok
+}
+
+// visibleTitle loads the movie or series with the imdb id, answering 404 if there is
+// none or the profile may not see it.
+func visibleTitle(w http.ResponseWriter, r *http.Request, profile models.Profile, imdbId string) (models.Title, bool) {
+	filter := catalogFilter(profile, bson.D{bson.E{Key: "imdb_id", Value: imdbId}})
+
+	var movie models.Movie
+	err := movieCollection.FindOne(r.Context(), filter).Decode(&movie)
+	if err == nil {
+		return movie, true
+	}
+	if err == mongo.ErrNoDocuments {
+		var series models.Series
+		err = seriesCollection.FindOne(r.Context(), filter).Decode(&series)
+		if err == nil {
+			return series, true
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Title not found"})
+		return nil, false
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"error": "failed to load title"})
+	return nil, false
+}
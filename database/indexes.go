@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes lists the indexes each collection needs. CreateMany is a no-op for
+// indexes that already exist so this is safe to run on every start.
+var indexes = map[string][]mongo.IndexModel{
+	"login_attempts": {
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"password_resets": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"passkeys": {
+		{Keys: bson.D{{Key: "credential_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"webauthn_sessions": {
+		{Keys: bson.D{{Key: "session_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"users": {
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "roles", Value: 1}}},
+		{Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}}},
+		{Keys: bson.D{{Key: "deletion_scheduled_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"oidc_states": {
+		{Keys: bson.D{{Key: "state", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"magic_links": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60)},
+	},
+	"email_limits": {
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "window_start", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60)},
+	},
+	"privacy_jobs": {
+		{Keys: bson.D{{Key: "job_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"movies": {
+		{Keys: bson.D{{Key: "maturity.age_level", Value: 1}}},
+		{Keys: bson.D{{Key: "credits.person_id", Value: 1}}},
+		// GetMovies filters and sorts on these
+		{Keys: bson.D{{Key: "release_date", Value: 1}}},
+		{Keys: bson.D{{Key: "runtime_minutes", Value: 1}}},
+		{Keys: bson.D{{Key: "title", Value: 1}}},
+		{Keys: bson.D{{Key: "spoken_languages", Value: 1}}},
+		{Keys: bson.D{{Key: "production_countries", Value: 1}}},
+	},
+	"series": {
+		{Keys: bson.D{{Key: "imdb_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "maturity.age_level", Value: 1}}},
+		{Keys: bson.D{{Key: "credits.person_id", Value: 1}}},
+	},
+	"people": {
+		{Keys: bson.D{{Key: "person_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "name", Value: 1}}},
+		// one per models.PersonSources, importers upsert on them
+		{Keys: bson.D{{Key: "external_ids.imdb", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "external_ids.tmdb", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "external_ids.wikidata", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	},
+	"episodes": {
+		{Keys: bson.D{{Key: "episode_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "series_id", Value: 1}, {Key: "season_number", Value: 1}, {Key: "episode_number", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"profiles": {
+		{Keys: bson.D{{Key: "profile_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		// one default profile per account, DefaultProfile relies on it
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "default", Value: true}})},
+	},
+	"watchlist": {
+		{Keys: bson.D{{Key: "profile_id", Value: 1}, {Key: "imdb_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "profile_id", Value: 1}, {Key: "added_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"watch_history": {
+		{Keys: bson.D{{Key: "profile_id", Value: 1}, {Key: "imdb_id", Value: 1}, {Key: "episode_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "profile_id", Value: 1}, {Key: "watched_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"roles": {
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"audit_log": {
+		// entries written before the hash chain have no seq
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "seq", Value: bson.D{{Key: "$gt", Value: 0}}}})},
+		{Keys: bson.D{{Key: "request_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "target_type", Value: 1}, {Key: "target_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+}
+
+// requiredIndexes are the collections whose indexes guard correctness rather than speed.
+// The audit hash chain relies on the unique seq index to stop two concurrent appends
+// from forking it, running without it is worse than not starting.
+var requiredIndexes = []string{"audit_log"}
+
+// EnsureIndexes creates the indexes. Failures are logged, except for requiredIndexes
+// which are returned.
+func EnsureIndexes(ctx context.Context) error {
+	for name, models := range indexes {
+		if _, err := OpenCollection(name).Indexes().CreateMany(ctx, models); err != nil {
+			if slices.Contains(requiredIndexes, name) {
+				return fmt.Errorf("indexes for %s: %w", name, err)
+			}
+			log.Printf("Failed to create indexes for %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migration changes existing documents once. Applied ids are kept in the migrations
+// collection. Two instances starting together can both run a migration, so Up has to
+// be safe to run again.
+type Migration struct {
+	ID string
+	Up func(ctx context.Context) error
+}
+
+// migrations run in order, append new ones at the end and never change the id of one
+// that has shipped.
+var migrations = []Migration{
+	{ID: "2026-10-movie-metadata", Up: backfillMovieMetadata},
+}
+
+func RunMigrations(ctx context.Context) error {
+	applied := OpenCollection("migrations")
+	for _, migration := range migrations {
+		count, err := applied.CountDocuments(ctx, bson.D{bson.E{Key: "_id", Value: migration.ID}})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		started := time.Now()
+		if err := migration.Up(ctx); err != nil {
+			return fmt.Errorf("migration %s: %w", migration.ID, err)
+		}
+		_, err = applied.InsertOne(ctx, bson.D{
+			bson.E{Key: "_id", Value: migration.ID},
+			bson.E{Key: "started_at", Value: started},
+			bson.E{Key: "applied_at", Value: time.Now()},
+		})
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		log.Printf("Applied migration %s", migration.ID)
+	}
+	return nil
+}
+
+// backfillMovieMetadata gives movies stored before models.MovieMetadata existed empty
+// languages, countries, texts and backdrops. Release date and runtime stay unset, they
+// aren't known.
+func backfillMovieMetadata(ctx context.Context) error {
+	movies := OpenCollection("movies")
+	defaults := []bson.E{
+		{Key: "original_language", Value: ""},
+		{Key: "spoken_languages", Value: bson.A{}},
+		{Key: "production_countries", Value: bson.A{}},
+		{Key: "tagline", Value: ""},
+		{Key: "synopsis", Value: ""},
+		{Key: "backdrops", Value: bson.A{}},
+	}
+	for _, field := range defaults {
+		// null too, nil slices used to be stored as null
+		_, err := movies.UpdateMany(ctx, bson.D{{Key: field.Key, Value: nil}}, bson.D{
+			{Key: "$set", Value: bson.D{field}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
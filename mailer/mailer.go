@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends plain text email. Swap Default for a MemoryMailer in tests so nothing
+// leaves the machine.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var Default Mailer = NewFromEnv()
+
+// NewFromEnv picks the implementation from MAILER: smtp, file (default) or memory.
+func NewFromEnv() Mailer {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if port == 0 {
+			port = 587
+		}
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	case "memory":
+		return &MemoryMailer{}
+	default:
+		dir := os.Getenv("MAIL_DROP_DIR")
+		if dir == "" {
+			dir = "maildrop"
+		}
+		log.Printf("mailer: writing outgoing mail to %s", dir)
+		return &FileMailer{Dir: dir, From: os.Getenv("MAIL_FROM")}
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"github.com/Chandra5468/movie-streaming/controllers"
 	"github.com/Chandra5468/movie-streaming/database"
 	custommiddleware "github.com/Chandra5468/movie-streaming/middleware"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/privacy"
+	"github.com/Chandra5468/movie-streaming/utils"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -19,34 +22,185 @@ import (
 func main() {
 	// Initializing MongoDB Client
 	database.GetClient()
+	if err := database.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("failed to create indexes: %v", err)
+	}
+	if err := database.RunMigrations(context.Background()); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	}
+	if err := utils.EnsureRoles(context.Background()); err != nil {
+		log.Fatalf("failed to set up roles: %v", err)
+	}
+
+	// background jobs stop with the server
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go controllers.RunAccountPurger(jobs)
+	go privacy.RunWorker(jobs)
 
 	// Create the router and apply middleware
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID) // id for logs and the audit trail
 	router.Use(middleware.Logger)    // Log all HTTP requests
 	router.Use(middleware.Recoverer) // Recover from panics
 	// global custom middleware
-	router.Use(custommiddleware.CORS)
+	corsPolicy := custommiddleware.CORSPolicyFromEnv()
+	router.Use(custommiddleware.CORS(corsPolicy, custommiddleware.CORSRulesFromEnv(corsPolicy)...))
+
+	router.Get("/.well-known/jwks.json", controllers.GetJWKS)
 
 	router.Route("/api", func(r chi.Router) {
-		r.Post("/register", controllers.RegisterUser)
-		r.Post("/login", controllers.LoginUser)
+		r.Use(custommiddleware.JSON)
+		defaultBudget := custommiddleware.Timeout(custommiddleware.DefaultTimeout)
+
+		r.With(defaultBudget).Post("/register", controllers.RegisterUser)
+		r.With(defaultBudget).Post("/login", controllers.LoginUser)
+		r.With(defaultBudget).Post("/login/2fa", controllers.LoginWithTOTP)
+		r.With(defaultBudget).Post("/login/passkey/begin", controllers.BeginPasskeyLogin)
+		r.With(defaultBudget).Post("/login/passkey/finish", controllers.FinishPasskeyLogin)
+		r.With(defaultBudget).Post("/login/magic", controllers.RequestMagicLink)
+		r.With(defaultBudget).Get("/login/magic/callback", controllers.MagicLinkCallback)
+		r.With(defaultBudget).Get("/oidc/{provider}/login", controllers.BeginOIDCLogin)
+		r.With(defaultBudget).Get("/oidc/{provider}/callback", controllers.OIDCCallback)
+		r.With(defaultBudget).Post("/refresh", controllers.RefreshTokenHandler)
+		r.With(defaultBudget).Get("/csrf", controllers.GetCSRFToken)
+		r.With(defaultBudget).Post("/verify-email", controllers.VerifyEmail)
+		r.With(defaultBudget).Post("/verify-email/resend", controllers.ResendVerificationEmail)
+		r.With(defaultBudget).Post("/password/forgot", controllers.ForgotPassword)
+		r.With(defaultBudget).Post("/password/reset", controllers.ResetPassword)
 
 		// Protected routes
 		r.Group(func(protected chi.Router) {
 			protected.Use(custommiddleware.Auth)
-			protected.Post("/logout", controllers.LogoutUser)
-			protected.Post("/movie", controllers.AddMovie)
-			protected.Get("/movies", controllers.GetMovies)
-			protected.Patch("/updatereview/:imdb_id", controllers.AdminReviewUpdate)
-			protected.Get("/recommended/movies", controllers.GetRecommendedMovies)
+			protected.Use(custommiddleware.CSRF)
+			protected.With(defaultBudget).Get("/me", controllers.GetMe)
+			protected.With(defaultBudget).Get("/me/privacy-jobs", controllers.GetPrivacyJobs)
+			protected.With(defaultBudget).Get("/passkeys", controllers.GetPasskeys)
+			protected.With(defaultBudget).Get("/profiles", controllers.GetProfiles)
+
+			// the account itself stays out of reach of an admin impersonating the user
+			protected.Group(func(account chi.Router) {
+				account.Use(custommiddleware.RejectImpersonation)
+				account.With(defaultBudget).Post("/logout", controllers.LogoutUser)
+				account.With(defaultBudget).Patch("/me", controllers.UpdateMe)
+				account.With(defaultBudget).Delete("/me", controllers.DeleteMe)
+				account.With(defaultBudget).Post("/me/export", controllers.RequestDataExport)
+				account.With(defaultBudget).Get("/me/exports/{job_id}", controllers.DownloadDataExport)
+				// an impersonating admin picks a profile with the X-Profile-ID header instead
+				account.With(defaultBudget).Post("/profiles/{profile_id}/select", controllers.SelectProfile)
+
+				account.Group(func(profiles chi.Router) {
+					profiles.Use(custommiddleware.ActiveProfile)
+					profiles.With(defaultBudget).Post("/profiles", controllers.CreateProfile)
+					profiles.With(defaultBudget).Patch("/profiles/{profile_id}", controllers.UpdateProfile)
+					profiles.With(defaultBudget).Delete("/profiles/{profile_id}", controllers.DeleteProfile)
+					profiles.With(defaultBudget).Put("/profiles/pin", controllers.SetProfilePIN)
+					profiles.With(defaultBudget).Put("/profiles/{profile_id}/blocked/{imdb_id}", controllers.BlockTitle)
+					profiles.With(defaultBudget).Delete("/profiles/{profile_id}/blocked/{imdb_id}", controllers.UnblockTitle)
+				})
+
+				// ways into the account, a kids profile can't add one and sign in past its PIN
+				account.Group(func(credentials chi.Router) {
+					credentials.Use(custommiddleware.ActiveProfile)
+					credentials.With(defaultBudget).Post("/me/password", controllers.ChangePassword)
+					credentials.With(defaultBudget).Post("/2fa/enroll", controllers.EnrollTOTP)
+					credentials.With(defaultBudget).Post("/2fa/confirm", controllers.ConfirmTOTP)
+					credentials.With(defaultBudget).Post("/2fa/disable", controllers.DisableTOTP)
+					credentials.With(defaultBudget).Post("/passkeys/register/begin", controllers.BeginPasskeyRegistration)
+					credentials.With(defaultBudget).Post("/passkeys/register/finish", controllers.FinishPasskeyRegistration)
+					credentials.With(defaultBudget).Delete("/passkeys/{credential_id}", controllers.DeletePasskey)
+				})
+			})
+
+			// catalog changes, reads go through the viewer group below
+			protected.Group(func(catalog chi.Router) {
+				catalog.Use(custommiddleware.RequirePermission(models.PermCatalogWrite), custommiddleware.RequireVerifiedEmail, custommiddleware.RequireAdminMFA)
+				catalog.With(defaultBudget).Post("/movie", controllers.AddMovie)
+				catalog.With(defaultBudget).Put("/movie/{imdb_id}/maturity", controllers.SetMovieMaturity)
+				catalog.With(defaultBudget).Patch("/movie/{imdb_id}/metadata", controllers.UpdateMovieMetadata)
+				catalog.With(defaultBudget).Post("/series", controllers.CreateSeries)
+				catalog.With(defaultBudget).Patch("/series/{series_id}", controllers.UpdateSeries)
+				catalog.With(defaultBudget).Delete("/series/{series_id}", controllers.DeleteSeries)
+				catalog.With(defaultBudget).Put("/series/{series_id}/seasons/{season_number}", controllers.PutSeason)
+				catalog.With(defaultBudget).Delete("/series/{series_id}/seasons/{season_number}", controllers.DeleteSeason)
+				catalog.With(defaultBudget).Post("/series/{series_id}/seasons/{season_number}/episodes", controllers.CreateEpisode)
+				catalog.With(defaultBudget).Patch("/episodes/{episode_id}", controllers.UpdateEpisode)
+				catalog.With(defaultBudget).Delete("/episodes/{episode_id}", controllers.DeleteEpisode)
+				catalog.With(defaultBudget).Put("/movie/{imdb_id}/credits", controllers.SetMovieCredits)
+				catalog.With(defaultBudget).Put("/series/{series_id}/credits", controllers.SetSeriesCredits)
+				catalog.With(defaultBudget).Post("/people", controllers.CreatePerson)
+				catalog.With(defaultBudget).Put("/people/external/{source}/{external_id}", controllers.UpsertPersonByExternalID)
+				catalog.With(defaultBudget).Patch("/people/{person_id}", controllers.UpdatePerson)
+				catalog.With(defaultBudget).Delete("/people/{person_id}", controllers.DeletePerson)
+			})
+
+			// everything a viewer sees or keeps is per profile
+			protected.Group(func(viewer chi.Router) {
+				viewer.Use(custommiddleware.ActiveProfile)
+				viewer.With(defaultBudget).Get("/movies", controllers.GetMovies)
+				viewer.With(defaultBudget).Get("/recommended/movies", controllers.GetRecommendedMovies)
+				viewer.With(defaultBudget).Get("/series", controllers.GetSeries)
+				viewer.With(defaultBudget).Get("/series/{series_id}", controllers.GetSeriesDetail)
+				viewer.With(defaultBudget).Get("/series/{series_id}/next-episode", controllers.GetNextEpisode)
+				viewer.With(defaultBudget).Get("/people", controllers.SearchPeople)
+				viewer.With(defaultBudget).Get("/people/{person_id}", controllers.GetPerson)
+				viewer.With(defaultBudget).Get("/watchlist", controllers.GetWatchlist)
+				viewer.With(defaultBudget).Put("/watchlist/{imdb_id}", controllers.AddToWatchlist)
+				viewer.With(defaultBudget).Delete("/watchlist/{imdb_id}", controllers.RemoveFromWatchlist)
+				viewer.With(defaultBudget).Get("/history", controllers.GetWatchHistory)
+				viewer.With(defaultBudget).Post("/history", controllers.RecordWatchProgress)
+			})
+
+			// review classification goes through the LLM
+			protected.With(custommiddleware.Timeout(custommiddleware.LLMTimeout), custommiddleware.RequirePermission(models.PermReviewsClassify), custommiddleware.RequireVerifiedEmail, custommiddleware.RequireAdminMFA).Patch("/updatereview/{imdb_id}", controllers.AdminReviewUpdate)
+
+			// each admin area needs its own permission, see models.AllPermissions
+			protected.Route("/admin", func(admin chi.Router) {
+				admin.Use(custommiddleware.RequireVerifiedEmail)
+				admin.Use(custommiddleware.RequireAdminMFA)
+				admin.With(defaultBudget, custommiddleware.RequirePermission(models.PermKeysManage)).Post("/keys/rotate", controllers.RotateSigningKey)
+
+				admin.Group(func(users chi.Router) {
+					users.Use(custommiddleware.RequirePermission(models.PermUsersManage))
+					users.With(defaultBudget).Get("/users", controllers.SearchUsers)
+					users.With(defaultBudget).Get("/users/{user_id}", controllers.GetUser)
+					users.With(defaultBudget).Post("/users/{user_id}/disable", controllers.DisableUser)
+					users.With(defaultBudget).Post("/users/{user_id}/enable", controllers.EnableUser)
+					users.With(defaultBudget).Post("/users/{user_id}/logout", controllers.ForceLogoutUser)
+					users.With(defaultBudget).Post("/users/{user_id}/unlock", controllers.UnlockUser)
+					users.With(defaultBudget).Post("/users/{user_id}/export", controllers.AdminRequestExport)
+					users.With(defaultBudget).Post("/users/{user_id}/erasure", controllers.AdminRequestErasure)
+					users.With(defaultBudget).Get("/privacy-jobs/{job_id}", controllers.GetPrivacyJob)
+					users.With(defaultBudget, custommiddleware.RequirePermission(models.PermUsersImpersonate)).Post("/users/{user_id}/impersonate", controllers.ImpersonateUser)
+				})
+
+				admin.Group(func(audit chi.Router) {
+					audit.Use(custommiddleware.RequirePermission(models.PermAuditRead))
+					audit.With(defaultBudget).Get("/audit", controllers.GetAuditEvents)
+					// streamed, Timeout would hold the whole response in memory
+					audit.With(custommiddleware.Deadline(custommiddleware.ExportTimeout)).Get("/audit/export", controllers.ExportAuditEvents)
+					audit.With(custommiddleware.Deadline(custommiddleware.ExportTimeout)).Get("/audit/verify", controllers.VerifyAuditLog)
+				})
+
+				admin.Group(func(roles chi.Router) {
+					roles.Use(custommiddleware.RequirePermission(models.PermRolesManage))
+					roles.With(defaultBudget).Get("/roles", controllers.GetRoles)
+					roles.With(defaultBudget).Post("/roles", controllers.CreateRole)
+					roles.With(defaultBudget).Put("/roles/{name}", controllers.UpdateRole)
+					roles.With(defaultBudget).Delete("/roles/{name}", controllers.DeleteRole)
+					// handing out roles is granting permissions, so it needs both
+					roles.With(defaultBudget, custommiddleware.RequirePermission(models.PermUsersManage)).Put("/users/{user_id}/roles", controllers.SetUserRoles)
+				})
+			})
 		})
 	})
 
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      router,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:        ":8080",
+		Handler:     router,
+		ReadTimeout: 10 * time.Second,
+		// must outlive the longest route budget so the timeout response can still be written
+		WriteTimeout: custommiddleware.MaxTimeout() + 5*time.Second,
 	}
 
 	// handling graceful shutdowns
@@ -63,6 +217,7 @@ func main() {
 	<-stop
 
 	log.Println("Shutting down server...")
+	stopJobs()
 
 	// Create a context with a timeout to ensure the server shuts down properly
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
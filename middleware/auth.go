@@ -2,46 +2,133 @@ package custommiddleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/Chandra5468/movie-streaming/models"
 	"github.com/Chandra5468/movie-streaming/utils"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+// tokenSources is the order Auth looks for an access token in, e.g. "bearer,cookie".
+// The first source that is present wins, the rest are not consulted.
+var tokenSources = utils.GetEnvList("AUTH_TOKEN_PRECEDENCE", []string{utils.AuthMethodBearer, utils.AuthMethodCookie})
+
+var errMalformedAuthHeader = errors.New("malformed authorization header")
+
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		/*
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			// stringArray := strings.Split(authHeader, "Bearer ")
-			// tokenString := stringArray[1]
-			tokenString := authHeader[len("Bearer "):]
-
-			if tokenString == "" {
-				http.Error(w, "Unauthorized bearer token is required", http.StatusUnauthorized)
-				return
-			}
+		tokenString, method, err := extractToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		claims, err := utils.ValidateToken(tokenString)
 
-		*/
-		tokenStringTemp, err := r.Cookie("access_token")
 		if err != nil {
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
-		claims, err := utils.ValidateToken(tokenStringTemp.Value)
 
+		// tokens don't outlive a sign-out everywhere, a role change or disabling the account
+		var issuedAt time.Time
+		if claims.IssuedAt != nil {
+			issuedAt = claims.IssuedAt.Time
+		}
+		switch err := utils.CheckSession(r.Context(), claims.UserId, issuedAt); {
+		case errors.Is(err, utils.ErrAccountDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, utils.ErrSessionRevoked):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			http.Error(w, "failed to check session", http.StatusServiceUnavailable)
+			return
+		}
+
+		// permissions are looked up rather than put in the token so role changes apply
+		// to sessions that are already running
+		permissions, err := utils.ResolvePermissions(r.Context(), claims.Roles)
 		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			http.Error(w, "failed to load permissions", http.StatusServiceUnavailable)
 			return
 		}
+		// impersonation is for seeing what the user sees, never for acting with their privileges
+		if claims.ImpersonatorID != "" {
+			permissions = []string{}
+		}
 
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, utils.UserID, claims.UserId)
-		ctx = context.WithValue(ctx, utils.Role, claims.Role)
+		ctx = context.WithValue(ctx, utils.Roles, claims.Roles)
+		ctx = context.WithValue(ctx, utils.Permissions, permissions)
+		ctx = context.WithValue(ctx, utils.AuthMethod, method)
+		ctx = context.WithValue(ctx, utils.EmailVerified, claims.EmailVerified)
+		ctx = context.WithValue(ctx, utils.MFA, claims.MFA)
+		ctx = context.WithValue(ctx, utils.ProfileID, claims.ProfileID)
+		ctx = context.WithValue(ctx, utils.LoginMethod, claims.LoginMethod)
+		ctx = context.WithValue(ctx, utils.AuthTime, claims.AuthTime)
+		if claims.ImpersonatorID != "" {
+			ctx = context.WithValue(ctx, utils.ImpersonatorID, claims.ImpersonatorID)
+		}
 		r = r.WithContext(ctx)
 
+		if claims.ImpersonatorID != "" {
+			serveImpersonated(w, r, next, claims)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// serveImpersonated records every request made with an impersonation token, with the
+// status it ended in, so the audit log shows exactly what the admin did as the user.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, next http.Handler, claims *utils.SignedDetails) {
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	defer func() {
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// the client may be gone by now, the record must still be written
+		utils.RecordAuditEvent(context.WithoutCancel(r.Context()), models.AuditEvent{
+			ActorID:    claims.ImpersonatorID,
+			Action:     "user.impersonated_request",
+			TargetType: "user",
+			TargetID:   claims.UserId,
+			Details:    map[string]any{"method": r.Method, "path": r.URL.Path, "status": status},
+			IP:         utils.ClientIP(r),
+		})
+	}()
+	next.ServeHTTP(ww, r)
+}
+
+func extractToken(r *http.Request) (string, string, error) {
+	for _, source := range tokenSources {
+		switch source {
+		case utils.AuthMethodBearer:
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				continue
+			}
+			// a header that is present but not a usable bearer token is rejected outright
+			// instead of silently falling back to the cookie
+			scheme, token, ok := strings.Cut(header, " ")
+			token = strings.TrimSpace(token)
+			if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" || strings.ContainsAny(token, " \t") {
+				return "", "", errMalformedAuthHeader
+			}
+			return token, utils.AuthMethodBearer, nil
+		case utils.AuthMethodCookie:
+			cookie, err := r.Cookie("access_token")
+			if err != nil || cookie.Value == "" {
+				continue
+			}
+			return cookie.Value, utils.AuthMethodCookie, nil
+		}
+	}
+	return "", "", errors.New("invalid token")
+}
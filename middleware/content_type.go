@@ -0,0 +1,12 @@
+package custommiddleware
+
+import "net/http"
+
+// JSON sets the default response content type for API routes.
+// Handlers that return something else just overwrite it.
+func JSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,17 +1,153 @@
 package custommiddleware
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-func CORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	"github.com/Chandra5468/movie-streaming/utils"
+)
 
-		if r.Method == http.MethodOptions {
-			return
+type CORSPolicy struct {
+	// Exact origins ("https://app.example.com"), wildcard subdomains ("https://*.example.com") or "*".
+	// "*" never gets Access-Control-Allow-Credentials, browsers reject that combination anyway.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORSRule applies a different policy to every path under PathPrefix.
+type CORSRule struct {
+	PathPrefix string
+	Policy     CORSPolicy
+}
+
+// CORSPolicyFromEnv builds the default policy from CORS_* env vars.
+func CORSPolicyFromEnv() CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins:   utils.GetEnvList("CORS_ALLOWED_ORIGINS", []string{"*"}),
+		AllowedMethods:   utils.GetEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+		AllowedHeaders:   utils.GetEnvList("CORS_ALLOWED_HEADERS", []string{"Content-Type", "Authorization", "X-Client-Type", utils.CSRFHeaderName, ProfileHeader}),
+		ExposedHeaders:   utils.GetEnvList("CORS_EXPOSED_HEADERS", nil),
+		AllowCredentials: utils.GetEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		MaxAge:           utils.GetEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+}
+
+// CORSRulesFromEnv builds the per-path policies on top of base. The admin API only
+// answers the origins in CORS_ADMIN_ALLOWED_ORIGINS, none by default, so a wildcard
+// default policy doesn't open it to every site.
+func CORSRulesFromEnv(base CORSPolicy) []CORSRule {
+	admin := base
+	admin.AllowedOrigins = utils.GetEnvList("CORS_ADMIN_ALLOWED_ORIGINS", nil)
+	return []CORSRule{{PathPrefix: "/api/admin", Policy: admin}}
+}
+
+// CORS handles preflight and simple requests. It has to sit on the root router,
+// chi never runs group middleware for an OPTIONS request that has no route,
+// so per-group policies are selected here by path prefix (longest prefix wins).
+func CORS(policy CORSPolicy, rules ...CORSRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := policy
+			longest := -1
+			for _, rule := range rules {
+				if strings.HasPrefix(r.URL.Path, rule.PathPrefix) && len(rule.PathPrefix) > longest {
+					p = rule.Policy
+					longest = len(rule.PathPrefix)
+				}
+			}
+
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !p.allowsAnyOrigin() {
+				w.Header().Add("Vary", "Origin")
+			}
+			if preflight {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			if origin == "" || !p.allowsOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if p.allowsAnyOrigin() {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if p.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if !preflight {
+				if len(p.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !containsFold(p.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+			if p.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func (p CORSPolicy) allowsAnyOrigin() bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// https://*.example.com matches https://a.example.com but not https://example.com
+		scheme, host, ok := strings.Cut(allowed, "://*.")
+		if !ok {
+			continue
+		}
+		prefix := scheme + "://"
+		suffix := "." + host
+		if len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+			strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, v) {
+			return true
 		}
-		w.Header().Set("Content-Type", "application/json")
-		next.ServeHTTP(w, r)
-	})
+	}
+	return false
 }
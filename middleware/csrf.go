@@ -0,0 +1,40 @@
+package custommiddleware
+
+import (
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// CSRF validates the double submit token on unsafe methods. It must run after Auth,
+// requests that authenticated with a bearer token are exempt since browsers never
+// attach those on their own.
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if method, _ := r.Context().Value(utils.AuthMethod).(string); method == utils.AuthMethodBearer {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Auth took the access token from this cookie, the csrf token has to be issued for it
+		session, err := r.Cookie("access_token")
+		if err != nil {
+			session = &http.Cookie{}
+		}
+		cookie, err := r.Cookie(utils.CSRFCookieName)
+		if err != nil || !utils.ValidCSRFToken(cookie.Value, r.Header.Get(utils.CSRFHeaderName), session.Value) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "invalid or missing csrf token"}`))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,21 @@
+package custommiddleware
+
+import (
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// RejectImpersonation keeps impersonated sessions away from the account itself:
+// credentials, second factors, sessions, deletion and data exports. It must run after Auth.
+func RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if utils.ImpersonatorFromContext(r.Context()) != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "not allowed while impersonating"}`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
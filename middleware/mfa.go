@@ -0,0 +1,25 @@
+package custommiddleware
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// RequireAdminMFA blocks admin sessions that weren't established with a second factor
+// when REQUIRE_ADMIN_2FA is on. The 2fa enrollment routes must stay outside of it.
+func RequireAdminMFA(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roles, _ := r.Context().Value(utils.Roles).([]string)
+		mfa, _ := r.Context().Value(utils.MFA).(bool)
+		if utils.RequireAdminMFA && slices.Contains(roles, models.RoleAdmin) && !mfa {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "two-factor authentication required for admin accounts"}`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
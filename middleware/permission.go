@@ -0,0 +1,25 @@
+package custommiddleware
+
+import (
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// RequirePermission only lets the request through if the user's roles grant every
+// one of the given permissions.
+func RequirePermission(perms ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, perm := range perms {
+				if !utils.HasPermission(r.Context(), perm) {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(`{"error": "forbidden"}`))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package custommiddleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProfileHeader picks a profile for a single request, without going through
+// POST /api/profiles/{id}/select.
+const ProfileHeader = "X-Profile-ID"
+
+// ActiveProfile resolves the profile the request acts as: the X-Profile-ID header, then
+// the profile in the token, then the account's default profile. The header can't be
+// used to get out of a kids profile, that takes the PIN. It must run after Auth.
+func ActiveProfile(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userId, _ := ctx.Value(utils.UserID).(string)
+		claimed, _ := ctx.Value(utils.ProfileID).(string)
+		requested := r.Header.Get(ProfileHeader)
+
+		var profile models.Profile
+		var err error
+		switch {
+		case requested != "" && requested != claimed:
+			profile, err = utils.GetProfile(ctx, userId, requested)
+			if err == nil {
+				var pinRequired bool
+				pinRequired, err = utils.ProfilePINRequired(ctx, userId, claimed, profile)
+				if err == nil && pinRequired {
+					profileError(w, http.StatusForbidden, "a PIN is needed to leave a kids profile")
+					return
+				}
+			}
+		case claimed != "":
+			profile, err = utils.GetProfile(ctx, userId, claimed)
+		default:
+			profile, err = utils.DefaultProfile(ctx, userId)
+		}
+		if err == mongo.ErrNoDocuments {
+			// a deleted profile doesn't fall back to the default one, that could be a way out of a kids profile
+			profileError(w, http.StatusNotFound, "profile not found, select another profile")
+			return
+		}
+		if err != nil {
+			profileError(w, http.StatusServiceUnavailable, "failed to load profile")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, utils.Profile, profile)))
+	})
+}
+
+func profileError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(`{"error": "` + msg + `"}`))
+}
@@ -0,0 +1,157 @@
+package custommiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Route budgets used by the router. Anything talking to the LLM gets the long one,
+// bulk exports get their own and run under Deadline.
+const (
+	DefaultTimeout = 10 * time.Second
+	LLMTimeout     = 60 * time.Second
+	ExportTimeout  = 30 * time.Minute
+)
+
+var (
+	budgetMu  sync.Mutex
+	maxBudget time.Duration
+)
+
+// MaxTimeout returns the longest budget handed to Timeout so far.
+// Call it after the router is built so the server WriteTimeout can cover every route.
+func MaxTimeout() time.Duration {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	return maxBudget
+}
+
+// Timeout puts a deadline on the request context. The same context is what handlers
+// pass down to mongo and the LLM client, so one budget covers the whole request.
+// If the deadline passes the client gets a 504 (503 if the request was cancelled),
+// whatever the handler managed to write is discarded.
+func Timeout(budget time.Duration) func(http.Handler) http.Handler {
+	budgetMu.Lock()
+	if budget > maxBudget {
+		maxBudget = budget
+	}
+	budgetMu.Unlock()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan struct{})
+			panicChan := make(chan any, 1)
+
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicChan <- p
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case p := <-panicChan:
+				panic(p) // let the recovery middleware deal with it
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				// handler may have returned because mongo/llm gave up on the deadline
+				if ctx.Err() != nil {
+					writeTimeout(w, ctx.Err())
+					return
+				}
+				dst := w.Header()
+				for k, v := range tw.header {
+					dst[k] = v
+				}
+				if tw.code == 0 {
+					tw.code = http.StatusOK
+				}
+				w.WriteHeader(tw.code)
+				w.Write(tw.buf.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				writeTimeout(w, ctx.Err())
+			}
+		})
+	}
+}
+
+// Deadline is Timeout for handlers that stream their response or run longer than the
+// server write timeout. The context gets the deadline but nothing is buffered, the
+// handler writes and flushes straight to the client and stops once the context is done.
+// The write timeout of the connection is moved out to cover the budget of this request.
+func Deadline(budget time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+
+			// leaves room for the handler to write its error after the deadline
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(budget + 5*time.Second)); err != nil {
+				log.Printf("failed to extend write deadline for %s: %v", r.URL.Path, err)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func writeTimeout(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(`{"error": "request timed out"}`))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(`{"error": "request cancelled"}`))
+}
+
+// timeoutWriter buffers the handler response so nothing reaches the client
+// once the deadline has fired.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
@@ -0,0 +1,20 @@
+package custommiddleware
+
+import (
+	"net/http"
+
+	"github.com/Chandra5468/movie-streaming/utils"
+)
+
+// RequireVerifiedEmail blocks accounts that haven't confirmed their email yet. Must run after Auth.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if verified, _ := r.Context().Value(utils.EmailVerified).(bool); !verified {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "email address not verified"}`))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEvent is one entry of the append-only audit log. Entries are chained: Hash is the
+// sha256 of the entry's own BSON (without _id and hash), which includes PrevHash, so
+// changing or removing an entry breaks every hash after it. Redacted entries had
+// personal data scrubbed by an erasure, RedactedHash covers what is left of them and is
+// vouched for by the audit.redacted entry appended before the change.
+type AuditEvent struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Seq        int64              `bson:"seq" json:"seq"`
+	ActorID    string             `bson:"actor_id" json:"actor_id"` // empty for events the system raises itself
+	Action     string             `bson:"action" json:"action"`
+	TargetType string             `bson:"target_type" json:"target_type"`
+	TargetID   string             `bson:"target_id" json:"target_id"`
+	Details    map[string]any     `bson:"details,omitempty" json:"details,omitempty"`
+	// state of the target before and after the change, only the fields that matter
+	Before       map[string]any `bson:"before,omitempty" json:"before,omitempty"`
+	After        map[string]any `bson:"after,omitempty" json:"after,omitempty"`
+	RequestID    string         `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	IP           string         `bson:"ip" json:"ip"`
+	CreatedAt    time.Time      `bson:"created_at" json:"created_at"`
+	PrevHash     string         `bson:"prev_hash" json:"prev_hash"`
+	Hash         string         `bson:"hash,omitempty" json:"hash"`
+	Redacted     bool           `bson:"redacted,omitempty" json:"redacted,omitempty"`
+	RedactedHash string         `bson:"redacted_hash,omitempty" json:"redacted_hash,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// EmailLimit counts the mails of one kind (password reset, verification, ...) sent to an
+// address in the current window, whether or not an account exists for it.
+type EmailLimit struct {
+	Kind        string    `bson:"kind" json:"kind"`
+	Email       string    `bson:"email" json:"email"`
+	Count       int       `bson:"count" json:"count"`
+	WindowStart time.Time `bson:"window_start" json:"window_start"`
+}
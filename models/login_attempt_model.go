@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// LoginAttempt tracks failed logins per email, whether or not an account exists for it,
+// so throttling looks the same for known and unknown emails.
+type LoginAttempt struct {
+	Email         string    `bson:"email" json:"email"`
+	FailedCount   int       `bson:"failed_count" json:"failed_count"`
+	LastFailedAt  time.Time `bson:"last_failed_at" json:"last_failed_at"`
+	NextAllowedAt time.Time `bson:"next_allowed_at" json:"next_allowed_at"`
+	LockedUntil   time.Time `bson:"locked_until" json:"locked_until"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// MagicLink only stores hashes: of the signed token that was emailed out and of the
+// cookie binding it to the browser that asked for it.
+type MagicLink struct {
+	TokenHash   string     `bson:"token_hash"`
+	BindingHash string     `bson:"binding_hash"`
+	UserID      string     `bson:"user_id"`
+	Email       string     `bson:"email"`
+	CreatedAt   time.Time  `bson:"created_at"`
+	ExpiresAt   time.Time  `bson:"expires_at"`
+	UsedAt      *time.Time `bson:"used_at"`
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -23,4 +25,33 @@ type Movie struct {
 	Genre       []Genre            `bson:"genres" json:"genres" validate:"required,dive"`          // keyword dive ensures nested keyword genre is also validated
 	AdminReview string             `bson:"admin_review" json:"admin_review"`
 	Ranking     Ranking            `bson:"rankings" json:"rankings" validate:"required"`
+	// unrated movies are only shown to adult profiles
+	Maturity *MaturityRating `bson:"maturity,omitempty" json:"maturity,omitempty"`
+	Credits  []Credit        `bson:"credits,omitempty" json:"credits,omitempty" validate:"dive"`
+
+	MovieMetadata `bson:",inline"`
+}
+
+// MovieMetadata is the descriptive part of a movie, it can be changed on its own through
+// PATCH /movie/{imdb_id}/metadata. Languages are ISO 639-1 codes and countries ISO 3166-1
+// alpha-2 codes, utils.NormalizeMovieMetadata puts them in canonical case first.
+type MovieMetadata struct {
+	// unknown release dates and runtimes stay unset so range filters don't match them
+	ReleaseDate         *time.Time `bson:"release_date,omitempty" json:"release_date,omitempty"`
+	RuntimeMinutes      int        `bson:"runtime_minutes,omitempty" json:"runtime_minutes,omitempty" validate:"min=0,max=1440"`
+	OriginalLanguage    string     `bson:"original_language" json:"original_language" validate:"omitempty,len=2,alpha,lowercase"`
+	SpokenLanguages     []string   `bson:"spoken_languages" json:"spoken_languages" validate:"max=50,dive,len=2,alpha,lowercase"`
+	ProductionCountries []string   `bson:"production_countries" json:"production_countries" validate:"max=50,dive,iso3166_1_alpha2"`
+	Tagline             string     `bson:"tagline" json:"tagline" validate:"max=300"`
+	Synopsis            string     `bson:"synopsis" json:"synopsis" validate:"max=5000"`
+	Backdrops           []string   `bson:"backdrops" json:"backdrops" validate:"max=20,dive,url"`
+}
+
+// MaturityRating is a certification from one rating system (MPAA, BBFC, ...). AgeLevel is
+// set by the server from System and Rating, see utils.NormalizeMaturity.
+type MaturityRating struct {
+	System      string   `bson:"system" json:"system" validate:"required"`
+	Rating      string   `bson:"rating" json:"rating" validate:"required"`
+	AgeLevel    int      `bson:"age_level" json:"age_level"`
+	Descriptors []string `bson:"descriptors,omitempty" json:"descriptors,omitempty"`
 }
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// OIDCState ties an authorization request to its callback. It is deleted when the
+// callback uses it and expires on its own otherwise.
+type OIDCState struct {
+	State        string    `bson:"state"`
+	Provider     string    `bson:"provider"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"code_verifier"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+}
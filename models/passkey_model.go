@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+type Passkey struct {
+	CredentialID string     `bson:"credential_id" json:"credential_id"` // base64url
+	UserID       string     `bson:"user_id" json:"-"`
+	Name         string     `bson:"name" json:"name"`
+	PublicKey    []byte     `bson:"public_key" json:"-"` // COSE_Key
+	SignCount    uint32     `bson:"sign_count" json:"-"`
+	Transports   []string   `bson:"transports,omitempty" json:"transports,omitempty"`
+	CreatedAt    time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt   *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+}
+
+// WebAuthnSession holds the challenge of a ceremony in progress, it is deleted when used
+// and expires on its own otherwise.
+type WebAuthnSession struct {
+	SessionID string    `bson:"session_id"`
+	Challenge []byte    `bson:"challenge"`
+	UserID    string    `bson:"user_id,omitempty"` // empty for login, we don't know the user yet
+	Ceremony  string    `bson:"ceremony"`          // registration or login
+	ExpiresAt time.Time `bson:"expires_at"`
+}
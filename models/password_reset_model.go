@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// PasswordReset only stores the sha256 of the token that was emailed out.
+type PasswordReset struct {
+	TokenHash string     `bson:"token_hash" json:"-"`
+	UserID    string     `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at" json:"used_at"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Credit roles.
+const (
+	CreditActor    = "actor"
+	CreditDirector = "director"
+	CreditWriter   = "writer"
+)
+
+// PersonSources are the catalogs importers identify people by. Each has a unique index
+// on external_ids.<source> so an import can be run again without creating duplicates.
+var PersonSources = []string{"imdb", "tmdb", "wikidata"}
+
+type Person struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	PersonID    string             `bson:"person_id" json:"person_id"`
+	Name        string             `bson:"name" json:"name" validate:"required,min=1,max=200"`
+	Biography   string             `bson:"biography" json:"biography" validate:"max=10000"`
+	ProfilePath string             `bson:"profile_path,omitempty" json:"profile_path,omitempty" validate:"omitempty,url"`
+	BirthDate   *time.Time         `bson:"birth_date,omitempty" json:"birth_date,omitempty"`
+	// source (one of PersonSources) to the id the person has there
+	ExternalIDs map[string]string `bson:"external_ids,omitempty" json:"external_ids,omitempty"`
+	CreatedAt   time.Time         `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time         `bson:"updated_at" json:"updated_at"`
+}
+
+// Credit links a person to a movie or series. Credits are kept on the title, ordered by
+// role and Order (billing order for actors).
+type Credit struct {
+	PersonID string `bson:"person_id" json:"person_id" validate:"required"`
+	// copied from the person so titles list their credits without a lookup
+	Name      string `bson:"name" json:"name"`
+	Role      string `bson:"role" json:"role" validate:"required,oneof=actor director writer"`
+	Character string `bson:"character,omitempty" json:"character,omitempty" validate:"max=200"`
+	Order     int    `bson:"order" json:"order" validate:"min=0"`
+}
+
+// FilmographyEntry is one credit of a person, with the title it is on.
+type FilmographyEntry struct {
+	ImdbID     string `json:"imdb_id"`
+	TitleType  string `json:"title_type"`
+	Title      string `json:"title"`
+	PosterPath string `json:"poster_path"`
+	Role       string `json:"role"`
+	Character  string `json:"character,omitempty"`
+	Order      int    `json:"order"`
+}
+
+type PersonDetail struct {
+	Person
+	Filmography []FilmographyEntry `json:"filmography"`
+}
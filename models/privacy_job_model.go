@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+const (
+	PrivacyJobExport  = "export"
+	PrivacyJobErasure = "erasure"
+
+	PrivacyJobPending   = "pending"
+	PrivacyJobRunning   = "running"
+	PrivacyJobCompleted = "completed"
+	PrivacyJobFailed    = "failed"
+)
+
+// PrivacyJob is a data export or erasure request. Jobs are never deleted, a completed
+// erasure job is the record that the data was erased.
+type PrivacyJob struct {
+	JobID       string           `bson:"job_id" json:"job_id"`
+	Type        string           `bson:"type" json:"type"`
+	UserID      string           `bson:"user_id" json:"user_id"`
+	RequestedBy string           `bson:"requested_by" json:"requested_by"` // user id, or "system" for the account purger
+	Status      string           `bson:"status" json:"status"`
+	Error       string           `bson:"error,omitempty" json:"error,omitempty"`
+	Summary     map[string]int64 `bson:"summary,omitempty" json:"summary,omitempty"` // documents exported/erased per collection
+	ArchivePath string           `bson:"archive_path,omitempty" json:"-"`
+	CreatedAt   time.Time        `bson:"created_at" json:"created_at"`
+	StartedAt   *time.Time       `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	CompletedAt *time.Time       `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	// exports can be downloaded until then, the archive is removed afterwards
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
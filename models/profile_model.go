@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Maturity levels are ages, a profile only sees titles rated at or below its level.
+const (
+	MaturityAdult = 18
+	// kids profiles can't be set above this
+	MaturityKidsMax = 12
+)
+
+// Profile is one viewer of a shared account. Recommendations, the watchlist and the
+// watch history belong to a profile rather than the account.
+type Profile struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	ProfileID       string             `bson:"profile_id" json:"profile_id"`
+	UserID          string             `bson:"user_id" json:"user_id"`
+	Name            string             `bson:"name" json:"name" validate:"required,min=1,max=30"`
+	Avatar          string             `bson:"avatar" json:"avatar" validate:"omitempty,url"`
+	FavouriteGenres []Genre            `bson:"favourite_genres" json:"favourite_genres" validate:"dive"`
+	MaturityLevel   int                `bson:"maturity_level" json:"maturity_level" validate:"min=0,max=18"`
+	Kids            bool               `bson:"kids" json:"kids"`
+	// imdb ids a parent blocked for this profile whatever their rating
+	BlockedTitles []string `bson:"blocked_titles,omitempty" json:"blocked_titles,omitempty"`
+	// the account holder's own profile, made on first use and never deleted
+	Default   bool      `bson:"default" json:"default"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type WatchlistItem struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID    string             `bson:"user_id" json:"-"`
+	ProfileID string             `bson:"profile_id" json:"profile_id"`
+	ImdbID    string             `bson:"imdb_id" json:"imdb_id"`
+	TitleType string             `bson:"title_type" json:"title_type"`
+	AddedAt   time.Time          `bson:"added_at" json:"added_at"`
+}
+
+// WatchHistoryEntry is where a profile got to in a movie or an episode, one per profile
+// and movie/episode. ImdbID is the series for episodes, EpisodeID is empty for movies.
+type WatchHistoryEntry struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID          string             `bson:"user_id" json:"-"`
+	ProfileID       string             `bson:"profile_id" json:"profile_id"`
+	ImdbID          string             `bson:"imdb_id" json:"imdb_id"`
+	TitleType       string             `bson:"title_type" json:"title_type"`
+	EpisodeID       string             `bson:"episode_id" json:"episode_id,omitempty"`
+	SeasonNumber    int                `bson:"season_number,omitempty" json:"season_number,omitempty"`
+	EpisodeNumber   int                `bson:"episode_number,omitempty" json:"episode_number,omitempty"`
+	PositionSeconds int                `bson:"position_seconds" json:"position_seconds"`
+	Completed       bool               `bson:"completed" json:"completed"`
+	WatchedAt       time.Time          `bson:"watched_at" json:"watched_at"`
+}
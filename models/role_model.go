@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Permissions guard the routes, roles are named sets of them that admins manage at runtime.
+const (
+	PermCatalogWrite    = "catalog:write"
+	PermReviewsClassify = "reviews:classify"
+	PermUsersManage     = "users:manage"
+	// sign in as another user to see what they see, see ImpersonateUser
+	PermUsersImpersonate = "users:impersonate"
+	PermAnalyticsRead    = "analytics:read"
+	PermRolesManage      = "roles:manage"
+	PermKeysManage       = "keys:manage"
+	PermAuditRead        = "audit:read"
+)
+
+// AllPermissions is every permission the code checks, roles can only be made from these.
+var AllPermissions = []string{
+	PermCatalogWrite,
+	PermReviewsClassify,
+	PermUsersManage,
+	PermUsersImpersonate,
+	PermAnalyticsRead,
+	PermRolesManage,
+	PermKeysManage,
+	PermAuditRead,
+}
+
+// Built-in roles always exist. ADMIN always holds every permission, USER is what
+// registration hands out and starts with none.
+const (
+	RoleAdmin = "ADMIN"
+	RoleUser  = "USER"
+)
+
+type Role struct {
+	Name        string    `bson:"name" json:"name" validate:"required,min=2,max=32,uppercase"`
+	Description string    `bson:"description" json:"description" validate:"max=200"`
+	Permissions []string  `bson:"permissions" json:"permissions"`
+	BuiltIn     bool      `bson:"built_in" json:"built_in"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+}
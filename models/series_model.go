@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Series holds its seasons, the episodes are documents of their own (see Episode) so a
+// long running show doesn't grow one document without bound.
+type Series struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	ImdbID     string             `bson:"imdb_id" json:"imdb_id" validate:"required"`
+	Title      string             `bson:"title" json:"title" validate:"required,min=2,max=500"`
+	Overview   string             `bson:"overview" json:"overview" validate:"max=5000"`
+	PosterPath string             `bson:"poster_path" json:"poster_path" validate:"required,url"`
+	YoutubeID  string             `bson:"youtube_id,omitempty" json:"youtube_id,omitempty"` // trailer
+	Genre      []Genre            `bson:"genres" json:"genres" validate:"required,dive"`
+	Maturity   *MaturityRating    `bson:"maturity,omitempty" json:"maturity,omitempty"`
+	Credits    []Credit           `bson:"credits,omitempty" json:"credits,omitempty" validate:"dive"`
+	// ordered by Number, specials are season 0
+	Seasons   []Season  `bson:"seasons" json:"seasons" validate:"dive"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type Season struct {
+	Number     int        `bson:"number" json:"number" validate:"min=0"`
+	Name       string     `bson:"name" json:"name" validate:"max=200"`
+	Overview   string     `bson:"overview" json:"overview" validate:"max=5000"`
+	PosterPath string     `bson:"poster_path,omitempty" json:"poster_path,omitempty" validate:"omitempty,url"`
+	AirDate    *time.Time `bson:"air_date,omitempty" json:"air_date,omitempty"`
+}
+
+type Episode struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	EpisodeID     string             `bson:"episode_id" json:"episode_id"`
+	SeriesID      string             `bson:"series_id" json:"series_id"` // imdb id of the series
+	SeasonNumber  int                `bson:"season_number" json:"season_number"`
+	EpisodeNumber int                `bson:"episode_number" json:"episode_number" validate:"min=1"`
+	Title         string             `bson:"title" json:"title" validate:"required,max=500"`
+	Overview      string             `bson:"overview" json:"overview" validate:"max=5000"`
+	// episodes that haven't aired yet are listed but never picked as the next one to watch
+	AirDate        *time.Time `bson:"air_date,omitempty" json:"air_date,omitempty"`
+	RuntimeMinutes int        `bson:"runtime_minutes" json:"runtime_minutes" validate:"min=0"`
+	Media          []MediaRef `bson:"media" json:"media" validate:"dive"`
+	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// MediaRef points at a playable asset of an episode.
+type MediaRef struct {
+	Kind     string `bson:"kind" json:"kind" validate:"required,oneof=stream trailer preview"`
+	URL      string `bson:"url" json:"url" validate:"required,url"`
+	Language string `bson:"language,omitempty" json:"language,omitempty" validate:"omitempty,bcp47_language_tag"`
+}
+
+// SeasonDetail is a season with its episodes, for GET /api/series/{series_id}.
+type SeasonDetail struct {
+	Season
+	Episodes []Episode `json:"episodes"`
+}
+
+type SeriesDetail struct {
+	Series
+	Seasons []SeasonDetail `json:"seasons"`
+}
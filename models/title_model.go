@@ -0,0 +1,32 @@
+package models
+
+// Movies and series share the imdb id space and are both titles: they can go on a
+// watchlist, show up in the history and are filtered by maturity the same way.
+const (
+	TitleTypeMovie  = "movie"
+	TitleTypeSeries = "series"
+)
+
+// Title is what the catalog needs from a movie or a series.
+type Title interface {
+	TitleID() string
+	TitleType() string
+	TitleName() string
+	TitlePoster() string
+	TitleMaturity() *MaturityRating
+	TitleCredits() []Credit
+}
+
+func (m Movie) TitleID() string                { return m.ImdbID }
+func (m Movie) TitleType() string              { return TitleTypeMovie }
+func (m Movie) TitleName() string              { return m.Title }
+func (m Movie) TitlePoster() string            { return m.PosterPath }
+func (m Movie) TitleMaturity() *MaturityRating { return m.Maturity }
+func (m Movie) TitleCredits() []Credit         { return m.Credits }
+
+func (s Series) TitleID() string                { return s.ImdbID }
+func (s Series) TitleType() string              { return TitleTypeSeries }
+func (s Series) TitleName() string              { return s.Title }
+func (s Series) TitlePoster() string            { return s.PosterPath }
+func (s Series) TitleMaturity() *MaturityRating { return s.Maturity }
+func (s Series) TitleCredits() []Credit         { return s.Credits }
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"slices"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -12,27 +13,101 @@ type User struct {
 	FirstName       string             `bson:"first_name" json:"first_name" validate:"required,min=2,max=20"`
 	LastName        string             `bson:"last_name" json:"last_name" validate:"required,min=2,max=20"`
 	Email           string             `bson:"email" json:"email" validate:"required,email"`
-	Password        string             `bson:"password" json:"password" validate:"required,min=6"`
-	Role            string             `bson:"role" json:"role" validate:"oneof=ADMIN USER"`
+	Password        string             `bson:"password" json:"password" validate:"required"` // strength is checked by utils.PasswordPolicy
+	Roles           []string           `bson:"roles" json:"roles"`                           // names from the roles collection
 	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
 	Token           string             `bson:"token" json:"token"`
 	RefreshToken    string             `bson:"refresh_token" json:"refresh_token"`
 	FavouriteGenres []Genre            `bson:"favourite_genres" json:"favourite_genres" validate:"required,dive"`
+	Status          string             `bson:"status" json:"status"`
+	EmailVerifiedAt *time.Time         `bson:"email_verified_at,omitempty" json:"email_verified_at,omitempty"`
+	// refresh tokens issued before this are rejected
+	SessionsRevokedAt *time.Time `bson:"sessions_revoked_at,omitempty" json:"-"`
+	// two factor auth, secrets and recovery code hashes never leave the server
+	TOTPEnabled       bool     `bson:"totp_enabled" json:"totp_enabled"`
+	TOTPSecret        string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastStep      int64    `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string `bson:"recovery_codes,omitempty" json:"-"`
+	// accounts at external OpenID Connect providers that can sign in as this user
+	Identities []ExternalIdentity `bson:"identities,omitempty" json:"identities,omitempty"`
+	// set by DELETE /api/me, the account is purged after this unless the user signs in again
+	DeletionScheduledAt *time.Time `bson:"deletion_scheduled_at,omitempty" json:"deletion_scheduled_at,omitempty"`
+	// disabled by an admin, no sign-in or token refresh until enabled again
+	DisabledAt     *time.Time `bson:"disabled_at,omitempty" json:"disabled_at,omitempty"`
+	DisabledReason string     `bson:"disabled_reason,omitempty" json:"disabled_reason,omitempty"`
+	// needed to switch from a kids profile to one that isn't, see utils.ProfilePINRequired
+	ProfilePIN            string     `bson:"profile_pin,omitempty" json:"-"`
+	ProfilePINFailures    int        `bson:"profile_pin_failures,omitempty" json:"-"`
+	ProfilePINLockedUntil *time.Time `bson:"profile_pin_locked_until,omitempty" json:"-"`
+}
+
+type ExternalIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email" json:"email"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+const (
+	UserStatusUnverified = "unverified"
+	UserStatusActive     = "active"
+)
+
+// IsEmailVerified treats accounts created before email verification existed (no status) as verified.
+func (u User) IsEmailVerified() bool {
+	return u.Status != UserStatusUnverified
 }
 
 type UserLogin struct {
 	Email    string `bson:"email" json:"email" validate:"required,email"`
 	Password string `bson:"password" json:"password" validate:"required,min=6"`
+	// non-browser clients (cli, mobile) can't use the cookies and ask for the tokens in the body
+	ReturnTokens bool `bson:"-" json:"return_tokens"`
 }
 
 type UserResponse struct {
-	UserId          string  `json:"user_id"`
-	FirstName       string  `json:"first_name"`
-	LastName        string  `json:"last_name"`
-	Email           string  `json:"email"`
-	Role            string  `json:"role"`
-	Token           string  `json:"token"`
-	RefreshToken    string  `json:"refresh_token"`
-	FavouriteGenres []Genre `json:"favourite_genres"`
+	UserId                string   `json:"user_id"`
+	FirstName             string   `json:"first_name"`
+	LastName              string   `json:"last_name"`
+	Email                 string   `json:"email"`
+	Roles                 []string `json:"roles"`
+	Permissions           []string `json:"permissions"`
+	Token                 string   `json:"token,omitempty"`
+	RefreshToken          string   `json:"refresh_token,omitempty"`
+	FavouriteGenres       []Genre  `json:"favourite_genres"`
+	EmailVerified         bool     `json:"email_verified"`
+	MFAEnrollmentRequired bool     `json:"mfa_enrollment_required,omitempty"`
+}
+
+// AccountResponse is what GET /api/me shows the user about their own account.
+type AccountResponse struct {
+	UserId          string             `json:"user_id"`
+	FirstName       string             `json:"first_name"`
+	LastName        string             `json:"last_name"`
+	Email           string             `json:"email"`
+	Roles           []string           `json:"roles"`
+	Permissions     []string           `json:"permissions,omitempty"`
+	FavouriteGenres []Genre            `json:"favourite_genres"`
+	EmailVerified   bool               `json:"email_verified"`
+	TOTPEnabled     bool               `json:"totp_enabled"`
+	HasPassword     bool               `json:"has_password"`
+	HasProfilePIN   bool               `json:"has_profile_pin"`
+	Identities      []ExternalIdentity `json:"identities"`
+	CreatedAt       time.Time          `json:"created_at"`
+}
+
+// AdminUserResponse is the admin view of a user, the account plus its state.
+type AdminUserResponse struct {
+	AccountResponse
+	Status              string     `json:"status"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	DisabledReason      string     `json:"disabled_reason,omitempty"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+func (u User) HasRole(name string) bool {
+	return slices.Contains(u.Roles, name)
 }
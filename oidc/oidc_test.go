@@ -0,0 +1,412 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "movie-stream"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://app.example.com/api/auth/oidc/mock/callback"
+	testKID          = "key-1"
+)
+
+// mockIdP is a local OpenID provider with discovery, a JWKS, an authorization endpoint
+// that consents right away and a token endpoint that checks PKCE.
+type mockIdP struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authRequest
+	// claims of the next issued id token, after the defaults
+	claims jwt.MapClaims
+}
+
+type authRequest struct {
+	challenge, nonce string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: map[string]authRequest{}, claims: jwt.MapClaims{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jwk{{
+			Kty: "EC", Kid: testKID, Use: "sig", Crv: "P-256",
+			X: b64.EncodeToString(idp.key.X.FillBytes(make([]byte, 32))),
+			Y: b64.EncodeToString(idp.key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code, _ := RandomString()
+	idp.mu.Lock()
+	idp.codes[code] = authRequest{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	idp.mu.Unlock()
+
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || secret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	// codes are single use
+	idp.mu.Lock()
+	req, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != req.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := idp.defaultClaims(req.nonce)
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: "access",
+		TokenType:   "Bearer",
+		IDToken:     idp.sign(claims, testKID, idp.key),
+		ExpiresIn:   3600,
+	})
+}
+
+func (idp *mockIdP) defaultClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            idp.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "ada@example.com",
+		"email_verified": true,
+	}
+}
+
+func (idp *mockIdP) sign(claims jwt.MapClaims, kid string, key *ecdsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func (idp *mockIdP) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "mock",
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+}
+
+// login runs the browser part: follows the authorization URL and returns what the
+// provider sent back to the redirect URL.
+func login(t *testing.T, p *Provider, state, nonce, challenge string) (code, returnedState string) {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), state, nonce, challenge)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := browser.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURL) {
+		t.Fatalf("redirected to %s", location)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestLoginFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	state, _ := RandomString()
+	nonce, _ := RandomString()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, returnedState := login(t, p, state, nonce, challenge)
+	if !StateMatches(state, returnedState) {
+		t.Fatal("state did not round trip")
+	}
+
+	tokens, err := p.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := p.VerifyIDToken(context.Background(), tokens.IDToken, nonce)
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "ada@example.com" || !claims.CanLinkByEmail() {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if claims.UsedMFA() {
+		t.Error("UsedMFA without an amr claim")
+	}
+
+	// the code is gone once it was exchanged
+	if _, err := p.Exchange(context.Background(), code, verifier); err == nil {
+		t.Error("code could be exchanged twice")
+	}
+}
+
+func TestExchangeChecksPKCEVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	_, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, _, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verifier := range []string{otherVerifier, ""} {
+		code, _ := login(t, p, "state", "nonce", challenge)
+		if _, err := p.Exchange(context.Background(), code, verifier); err == nil {
+			t.Errorf("code exchanged with verifier %q", verifier)
+		}
+	}
+}
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 7636 section 4.1
+	if len(verifier) < 43 || len(verifier) > 128 {
+		t.Errorf("verifier length %d", len(verifier))
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Error("challenge is not the S256 hash of the verifier")
+	}
+}
+
+func TestStateMatches(t *testing.T) {
+	for _, test := range []struct {
+		expected, returned string
+		want               bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "", false},
+		{"", "", false},
+		{"abc", "abcd", false},
+	} {
+		if got := StateMatches(test.expected, test.returned); got != test.want {
+			t.Errorf("StateMatches(%q, %q) = %v, want %v", test.expected, test.returned, got, test.want)
+		}
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		claims jwt.MapClaims
+		kid    string
+		key    *ecdsa.PrivateKey
+		nonce  string
+		want   error
+	}{
+		{name: "nonce mismatch", nonce: "other-nonce", want: ErrNonceMismatch},
+		{name: "missing nonce", claims: jwt.MapClaims{"nonce": ""}, want: ErrNonceMismatch},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://evil.example.net"}, want: ErrInvalidIDToken},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "someone-else"}, want: ErrInvalidIDToken},
+		{
+			name:   "multiple audiences without azp",
+			claims: jwt.MapClaims{"aud": []string{testClientID, "someone-else"}},
+			want:   ErrInvalidIDToken,
+		},
+		{
+			name:   "expired",
+			claims: jwt.MapClaims{"iat": time.Now().Add(-3 * time.Hour).Unix(), "exp": time.Now().Add(-2 * time.Hour).Unix()},
+			want:   ErrInvalidIDToken,
+		},
+		{name: "missing expiry", claims: jwt.MapClaims{"exp": nil}, want: ErrInvalidIDToken},
+		{name: "missing subject", claims: jwt.MapClaims{"sub": ""}, want: ErrInvalidIDToken},
+		{name: "unknown kid", kid: "key-2", want: ErrInvalidIDToken},
+		{name: "signed with another key", key: otherKey, want: ErrInvalidIDToken},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := idp.provider()
+
+			claims := idp.defaultClaims("nonce")
+			for k, v := range test.claims {
+				if v == nil {
+					delete(claims, k)
+					continue
+				}
+				claims[k] = v
+			}
+			kid, key, nonce := testKID, idp.key, "nonce"
+			if test.kid != "" {
+				kid = test.kid
+			}
+			if test.key != nil {
+				key = test.key
+			}
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+
+			_, err := p.VerifyIDToken(context.Background(), idp.sign(claims, kid, key), nonce)
+			if !errors.Is(err, test.want) {
+				t.Fatalf("VerifyIDToken error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsUnsignedToken(t *testing.T) {
+	idp := newMockIdP(t)
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, idp.defaultClaims("nonce"))
+	token.Header["kid"] = testKID
+	raw, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idp.provider().VerifyIDToken(context.Background(), raw, "nonce"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("VerifyIDToken error = %v, want %v", err, ErrInvalidIDToken)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	p := NewProvider(Config{Issuer: idp.URL + "/other", ClientID: testClientID})
+	// the other issuer serves no metadata, point discovery at the mock anyway
+	p.HTTPClient = &http.Client{Transport: rewriteTransport{to: idp.URL}}
+	if _, err := p.Discover(context.Background()); err == nil {
+		t.Fatal("discovery accepted metadata for another issuer")
+	}
+}
+
+type rewriteTransport struct{ to string }
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(rt.to + "/.well-known/openid-configuration")
+	r = r.Clone(r.Context())
+	r.URL = target
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestCanLinkByEmail(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		email    string
+		verified any
+		want     bool
+	}{
+		{"verified", "ada@example.com", true, true},
+		{"verified as string", "ada@example.com", "true", true},
+		{"unverified", "ada@example.com", false, false},
+		{"unverified as string", "ada@example.com", "false", false},
+		{"no email_verified claim", "ada@example.com", nil, false},
+		{"no email", "", true, false},
+	} {
+		claims := &IDTokenClaims{Email: test.email, EmailVerified: test.verified}
+		if got := claims.CanLinkByEmail(); got != test.want {
+			t.Errorf("%s: CanLinkByEmail() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUsedMFA(t *testing.T) {
+	for _, test := range []struct {
+		amr  []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"pwd"}, false},
+		{[]string{"pwd", "otp"}, true},
+		{[]string{"hwk"}, true},
+		{[]string{"mfa"}, true},
+	} {
+		claims := &IDTokenClaims{AMR: test.amr}
+		if got := claims.UsedMFA(); got != test.want {
+			t.Errorf("UsedMFA(%v) = %v, want %v", test.amr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package privacy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/mailer"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var jobCollection *mongo.Collection = database.OpenCollection("privacy_jobs")
+
+var (
+	ExportDir         = utils.GetEnvString("PRIVACY_EXPORT_DIR", "exports")
+	exportTTL         = utils.GetEnvDuration("PRIVACY_EXPORT_TTL", 7*24*time.Hour)
+	exportsURL        = utils.GetEnvString("PRIVACY_EXPORTS_URL", "http://localhost:3000/account/exports")
+	jobPollInterval   = utils.GetEnvDuration("PRIVACY_JOB_POLL_INTERVAL", 10*time.Second)
+	staleJobAfter     = utils.GetEnvDuration("PRIVACY_JOB_STALE_AFTER", time.Hour)
+	ErrJobNotFound    = errors.New("privacy job not found")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrArchiveExpired = errors.New("export archive is no longer available")
+)
+
+// SystemActor is RequestedBy for jobs nobody asked for directly, like the account purger.
+const SystemActor = "system"
+
+// Enqueue creates a pending job, or returns the one already waiting for the same user
+// and type so double clicks don't export or erase twice.
+func Enqueue(ctx context.Context, jobType, userId, requestedBy string) (models.PrivacyJob, error) {
+	var job models.PrivacyJob
+	err := jobCollection.FindOne(ctx, bson.D{
+		bson.E{Key: "type", Value: jobType},
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "status", Value: bson.D{bson.E{Key: "$in", Value: bson.A{models.PrivacyJobPending, models.PrivacyJobRunning}}}},
+	}).Decode(&job)
+	if err == nil {
+		return job, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return job, err
+	}
+
+	job = models.PrivacyJob{
+		JobID:       primitive.NewObjectID().Hex(),
+		Type:        jobType,
+		UserID:      userId,
+		RequestedBy: requestedBy,
+		Status:      models.PrivacyJobPending,
+		CreatedAt:   time.Now(),
+	}
+	_, err = jobCollection.InsertOne(ctx, job)
+	return job, err
+}
+
+func GetJob(ctx context.Context, jobId string) (models.PrivacyJob, error) {
+	var job models.PrivacyJob
+	err := jobCollection.FindOne(ctx, bson.D{bson.E{Key: "job_id", Value: jobId}}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return job, ErrJobNotFound
+	}
+	return job, err
+}
+
+func UserJobs(ctx context.Context, userId string) ([]models.PrivacyJob, error) {
+	cursor, err := jobCollection.Find(ctx, bson.D{bson.E{Key: "user_id", Value: userId}},
+		options.Find().SetSort(bson.D{bson.E{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []models.PrivacyJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ArchivePath returns the file of a completed export that hasn't expired.
+func ArchivePath(job models.PrivacyJob) (string, error) {
+	if job.Type != models.PrivacyJobExport || job.Status != models.PrivacyJobCompleted {
+		return "", ErrJobNotFound
+	}
+	if job.ArchivePath == "" || job.ExpiresAt == nil || time.Now().After(*job.ExpiresAt) {
+		return "", ErrArchiveExpired
+	}
+	return job.ArchivePath, nil
+}
+
+// RunWorker processes pending jobs every PRIVACY_JOB_POLL_INTERVAL until ctx is done.
+// Jobs are claimed atomically so several instances can run it side by side.
+func RunWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			job, err := claimJob(ctx)
+			if err != nil {
+				if err != mongo.ErrNoDocuments {
+					log.Printf("failed to claim privacy job: %v", err)
+				}
+				break
+			}
+			runJob(ctx, job)
+		}
+		if err := removeExpiredArchives(ctx); err != nil {
+			log.Printf("failed to remove expired exports: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimJob takes the oldest pending job. Jobs left running by an instance that died
+// are picked up again after PRIVACY_JOB_STALE_AFTER.
+func claimJob(ctx context.Context) (models.PrivacyJob, error) {
+	now := time.Now()
+	var job models.PrivacyJob
+	err := jobCollection.FindOneAndUpdate(ctx, bson.D{
+		bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "status", Value: models.PrivacyJobPending}},
+			bson.D{
+				bson.E{Key: "status", Value: models.PrivacyJobRunning},
+				bson.E{Key: "started_at", Value: bson.D{bson.E{Key: "$lt", Value: now.Add(-staleJobAfter)}}},
+			},
+		}},
+	}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "status", Value: models.PrivacyJobRunning},
+			bson.E{Key: "started_at", Value: now},
+		}},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.D{bson.E{Key: "created_at", Value: 1}}).
+		SetReturnDocument(options.After),
+	).Decode(&job)
+	return job, err
+}
+
+func runJob(ctx context.Context, job models.PrivacyJob) {
+	var (
+		summary map[string]int64
+		archive string
+		err     error
+	)
+	switch job.Type {
+	case models.PrivacyJobExport:
+		archive, summary, err = export(ctx, job)
+	case models.PrivacyJobErasure:
+		summary, err = erase(ctx, job)
+	default:
+		err = fmt.Errorf("unknown job type %q", job.Type)
+	}
+
+	now := time.Now()
+	set := bson.D{bson.E{Key: "completed_at", Value: now}}
+	if err != nil {
+		log.Printf("privacy job %s failed: %v", job.JobID, err)
+		set = append(set, bson.E{Key: "status", Value: models.PrivacyJobFailed}, bson.E{Key: "error", Value: err.Error()})
+	} else {
+		set = append(set, bson.E{Key: "status", Value: models.PrivacyJobCompleted}, bson.E{Key: "summary", Value: summary})
+		if archive != "" {
+			set = append(set, bson.E{Key: "archive_path", Value: archive}, bson.E{Key: "expires_at", Value: now.Add(exportTTL)})
+		}
+	}
+	if _, err := jobCollection.UpdateOne(ctx, bson.D{bson.E{Key: "job_id", Value: job.JobID}}, bson.D{
+		bson.E{Key: "$set", Value: set},
+	}); err != nil {
+		log.Printf("failed to update privacy job %s: %v", job.JobID, err)
+	}
+
+	if err == nil {
+		utils.RecordAuditEvent(ctx, models.AuditEvent{
+			ActorID:    actor(job),
+			Action:     "privacy." + job.Type + "_completed",
+			TargetType: "user",
+			TargetID:   job.UserID,
+			Details:    map[string]any{"job_id": job.JobID, "summary": summary},
+		})
+	}
+}
+
+func actor(job models.PrivacyJob) string {
+	if job.RequestedBy == SystemActor {
+		return ""
+	}
+	return job.RequestedBy
+}
+
+func findUser(ctx context.Context, userId string) (models.User, error) {
+	var user models.User
+	err := database.OpenCollection("users").FindOne(ctx, bson.D{bson.E{Key: "user_id", Value: userId}}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// export writes everything stored about the user to one JSON file. Documents are in
+// relaxed extended JSON so dates and ids keep their type.
+func export(ctx context.Context, job models.PrivacyJob) (string, map[string]int64, error) {
+	user, err := findUser(ctx, job.UserID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := map[string][]json.RawMessage{}
+	summary := map[string]int64{}
+	for _, source := range Sources {
+		if source.SkipExport {
+			continue
+		}
+		opts := options.Find()
+		projection := bson.D{bson.E{Key: "_id", Value: 0}}
+		for _, field := range source.Omit {
+			projection = append(projection, bson.E{Key: field, Value: 0})
+		}
+		opts.SetProjection(projection)
+
+		cursor, err := database.OpenCollection(source.Collection).Find(ctx, source.Filter(user), opts)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", source.Collection, err)
+		}
+		docs := []json.RawMessage{}
+		for cursor.Next(ctx) {
+			doc, err := bson.MarshalExtJSON(cursor.Current, false, false)
+			if err != nil {
+				cursor.Close(ctx)
+				return "", nil, fmt.Errorf("%s: %w", source.Collection, err)
+			}
+			docs = append(docs, doc)
+		}
+		err = cursor.Err()
+		cursor.Close(ctx)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", source.Collection, err)
+		}
+		data[source.Collection] = docs
+		summary[source.Collection] = int64(len(docs))
+	}
+
+	archive, err := json.MarshalIndent(map[string]any{
+		"user_id":      user.UserID,
+		"generated_at": time.Now().UTC(),
+		"data":         data,
+	}, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := os.MkdirAll(ExportDir, 0o700); err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(ExportDir, job.JobID+".json")
+	if err := os.WriteFile(path, archive, 0o600); err != nil {
+		return "", nil, err
+	}
+
+	err = mailer.Default.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"The export of your data is ready. You can download it from your account for the next " + exportTTL.String() + ".\n\n" +
+			exportsURL + "\n",
+	})
+	if err != nil {
+		log.Printf("failed to send export notice for job %s: %v", job.JobID, err)
+	}
+	return path, summary, nil
+}
+
+// erase deletes or anonymizes the user's data in every source. A user that is already
+// gone counts as erased so a job that died after deleting the user still completes.
+func erase(ctx context.Context, job models.PrivacyJob) (map[string]int64, error) {
+	user, err := findUser(ctx, job.UserID)
+	if err == ErrUserNotFound {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// archives of earlier exports are personal data too
+	jobs, err := UserJobs(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range jobs {
+		if j.ArchivePath != "" {
+			if err := os.Remove(j.ArchivePath); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	if _, err := jobCollection.UpdateMany(ctx, byUserID(user), bson.D{
+		bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "archive_path", Value: ""}}},
+	}); err != nil {
+		return nil, err
+	}
+
+	summary := map[string]int64{}
+	for _, source := range Sources {
+		collection := database.OpenCollection(source.Collection)
+		switch source.Erase {
+		case Delete:
+			result, err := collection.DeleteMany(ctx, source.Filter(user))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source.Collection, err)
+			}
+			summary[source.Collection] = result.DeletedCount
+		case Anonymize:
+			result, err := collection.UpdateMany(ctx, source.Filter(user), bson.D{bson.E{Key: "$set", Value: source.Anonymize}})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source.Collection, err)
+			}
+			summary[source.Collection] = result.ModifiedCount
+		case Redact:
+			redacted, err := utils.RedactAuditEvents(ctx, source.Filter(user), source.Anonymize)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source.Collection, err)
+			}
+			summary[source.Collection] = redacted
+		}
+	}
+
+	err = mailer.Default.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your account has been deleted",
+		Body: "Hi " + user.FirstName + ",\n\n" +
+			"Your account and the data we held about you have been deleted.\n",
+	})
+	if err != nil {
+		log.Printf("failed to send erasure notice for job %s: %v", job.JobID, err)
+	}
+	return summary, nil
+}
+
+func removeExpiredArchives(ctx context.Context) error {
+	cursor, err := jobCollection.Find(ctx, bson.D{
+		bson.E{Key: "archive_path", Value: bson.D{bson.E{Key: "$exists", Value: true}}},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$lt", Value: time.Now()}}},
+	})
+	if err != nil {
+		return err
+	}
+	var jobs []models.PrivacyJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if err := os.Remove(job.ArchivePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if _, err := jobCollection.UpdateOne(ctx, bson.D{bson.E{Key: "job_id", Value: job.JobID}}, bson.D{
+			bson.E{Key: "$unset", Value: bson.D{bson.E{Key: "archive_path", Value: ""}}},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package privacy
+
+import (
+	"strings"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/Chandra5468/movie-streaming/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type EraseMode int
+
+const (
+	// Delete removes the matching documents.
+	Delete EraseMode = iota
+	// Anonymize keeps the documents but overwrites the fields in Source.Anonymize.
+	Anonymize
+	// Redact is Anonymize for the audit log, the chain records what was changed so it
+	// still verifies.
+	Redact
+	// Retain keeps the documents as they are, for data we have to keep (audit trail, the
+	// erasure record itself). They only hold the opaque user id once the user is gone.
+	Retain
+)
+
+// Source is a collection holding personal data and how to find a user's documents in it.
+type Source struct {
+	Collection string
+	Filter     func(user models.User) bson.D
+	// fields left out of exports, secrets that are no use to the user
+	Omit       []string
+	SkipExport bool
+	Erase      EraseMode
+	Anonymize  bson.D
+}
+
+func byUserID(user models.User) bson.D {
+	return bson.D{bson.E{Key: "user_id", Value: user.UserID}}
+}
+
+// byEmail matches documents keyed by the normalized email rather than the user.
+func byEmail(user models.User) bson.D {
+	return bson.D{bson.E{Key: "email", Value: strings.ToLower(strings.TrimSpace(user.Email))}}
+}
+
+func byAuditEmail(user models.User) bson.D {
+	return bson.D{
+		bson.E{Key: "target_type", Value: "email"},
+		bson.E{Key: "target_id", Value: bson.D{bson.E{Key: "$in", Value: bson.A{
+			user.Email, strings.ToLower(strings.TrimSpace(user.Email)), utils.AuditEmailTarget(user.Email),
+		}}}},
+	}
+}
+
+// Sources lists every collection with data tied to a user. Anything new that stores
+// personal data has to be added here or it is missed by exports and erasure.
+// users is last so an erasure that fails halfway can be run again.
+var Sources = []Source{
+	{Collection: "passkeys", Filter: byUserID, Erase: Delete},
+	{Collection: "webauthn_sessions", Filter: byUserID, SkipExport: true, Erase: Delete},
+	{Collection: "password_resets", Filter: byUserID, Omit: []string{"token_hash"}, Erase: Delete},
+	{Collection: "magic_links", Filter: byUserID, Omit: []string{"token_hash", "binding_hash"}, Erase: Delete},
+	{Collection: "email_limits", Filter: byEmail, Erase: Delete},
+	{Collection: "login_attempts", Filter: byEmail, Erase: Delete},
+	{Collection: "audit_log", Filter: func(user models.User) bson.D {
+		return bson.D{bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "actor_id", Value: user.UserID}},
+			bson.D{bson.E{Key: "target_id", Value: user.UserID}},
+			byAuditEmail(user),
+		}}}
+	}, Erase: Retain},
+	// events about the address rather than the account (lockouts before it was known,
+	// older ones with the raw address) are scrubbed
+	{Collection: "audit_log", Filter: byAuditEmail, SkipExport: true, Erase: Redact, Anonymize: bson.D{
+		bson.E{Key: "target_id", Value: ""},
+	}},
+	{Collection: "privacy_jobs", Filter: byUserID, Omit: []string{"archive_path"}, Erase: Retain},
+	{Collection: "profiles", Filter: byUserID, Erase: Delete},
+	{Collection: "watchlist", Filter: byUserID, Erase: Delete},
+	{Collection: "watch_history", Filter: byUserID, Erase: Delete},
+	{Collection: "users", Filter: byUserID, Omit: []string{
+		"password", "token", "refresh_token", "totp_secret", "totp_pending_secret", "totp_last_step", "recovery_codes",
+		"profile_pin", "profile_pin_failures", "profile_pin_locked_until",
+	}, Erase: Delete},
+}
@@ -0,0 +1,410 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var auditCollection *mongo.Collection = database.OpenCollection("audit_log")
+
+// appending races with other writers on the unique seq index, the loser reads the new
+// head and tries again
+const auditAppendAttempts = 10
+
+// RecordAuditEvent appends an event to the audit log. Failing to audit must not fail the
+// request that triggered it, so errors are only logged.
+func RecordAuditEvent(ctx context.Context, event models.AuditEvent) {
+	event.CreatedAt = time.Now()
+	if event.RequestID == "" {
+		event.RequestID = middleware.GetReqID(ctx)
+	}
+	if err := appendAuditEvent(ctx, event); err != nil {
+		log.Printf("failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+func appendAuditEvent(ctx context.Context, event models.AuditEvent) error {
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		head, err := auditHead(ctx)
+		if err != nil {
+			return err
+		}
+		event.Seq = head.Seq + 1
+		event.PrevHash = head.Hash
+		event.Hash = ""
+
+		// details/before/after are maps whose field order changes from one marshal to the
+		// next, so the exact bytes that were hashed are what gets stored
+		body, err := bson.Marshal(event)
+		if err != nil {
+			return err
+		}
+		elements, err := bson.Raw(body).Elements()
+		if err != nil {
+			return err
+		}
+		doc := make(bson.D, 0, len(elements)+1)
+		for _, element := range elements {
+			doc = append(doc, bson.E{Key: element.Key(), Value: element.Value()})
+		}
+		doc = append(doc, bson.E{Key: "hash", Value: auditHash(body)})
+
+		_, err = auditCollection.InsertOne(ctx, doc)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return err
+	}
+	return errors.New("audit log is too busy")
+}
+
+// auditHead is the last chained entry. Entries from before the chain existed have no
+// seq and are skipped, the chain starts after them.
+func auditHead(ctx context.Context) (models.AuditEvent, error) {
+	var head models.AuditEvent
+	err := auditCollection.FindOne(ctx, bson.D{bson.E{Key: "seq", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}},
+		options.FindOne().
+			SetSort(bson.D{bson.E{Key: "seq", Value: -1}}).
+			SetProjection(bson.D{bson.E{Key: "seq", Value: 1}, bson.E{Key: "hash", Value: 1}}),
+	).Decode(&head)
+	if err == mongo.ErrNoDocuments {
+		return head, nil
+	}
+	return head, err
+}
+
+func auditHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditEmailTarget is the target id for events about an email address with no account
+// behind it, so the address itself is never written to the log.
+func AuditEmailTarget(email string) string {
+	return auditHash([]byte(normalizeEmail(email)))
+}
+
+// AuditChainReport is the result of VerifyAuditChain. BrokenAt is the seq of the first
+// entry that doesn't check out, zero when the chain is intact.
+type AuditChainReport struct {
+	Checked  int64  `json:"checked"`
+	Redacted int64  `json:"redacted"`
+	Intact   bool   `json:"intact"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain recomputes every hash in seq order. Each entry is hashed from its
+// stored BSON so nothing is lost to decoding. A redacted entry is checked against the
+// hash its audit.redacted entry committed to instead.
+func VerifyAuditChain(ctx context.Context) (AuditChainReport, error) {
+	report := AuditChainReport{Intact: true}
+
+	cursor, err := auditCollection.Find(ctx, bson.D{bson.E{Key: "seq", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}},
+		options.Find().SetSort(bson.D{bson.E{Key: "seq", Value: 1}}))
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+
+	// redacted entries waiting for the audit.redacted entry that vouches for them
+	unconfirmed := map[int64]string{}
+	var prevSeq int64
+	prevHash := ""
+	for cursor.Next(ctx) {
+		entry, err := auditEntry(cursor.Current)
+		if err != nil {
+			return report, err
+		}
+		report.Checked++
+
+		var reason string
+		switch {
+		case entry.seq != prevSeq+1:
+			reason = fmt.Sprintf("expected seq %d", prevSeq+1)
+		case entry.prevHash != prevHash:
+			reason = "prev_hash does not match the previous entry"
+		case entry.redacted && auditHash(entry.body) != entry.redactedHash:
+			reason = "redacted entry does not match its redaction"
+		case !entry.redacted && auditHash(entry.body) != entry.hash:
+			reason = "hash does not match the entry"
+		}
+		if reason != "" {
+			report.Intact = false
+			report.BrokenAt = entry.seq
+			report.Reason = reason
+			return report, nil
+		}
+
+		if entry.redacted {
+			report.Redacted++
+			unconfirmed[entry.seq] = entry.redactedHash
+		}
+		if seq, hash, ok := auditRedaction(cursor.Current); ok && unconfirmed[seq] == hash {
+			delete(unconfirmed, seq)
+		}
+		prevSeq, prevHash = entry.seq, entry.hash
+	}
+	if err := cursor.Err(); err != nil {
+		return report, err
+	}
+
+	if len(unconfirmed) > 0 {
+		report.Intact = false
+		report.BrokenAt = slices.Min(slices.Collect(maps.Keys(unconfirmed)))
+		report.Reason = "redacted entry has no audit.redacted entry"
+	}
+	return report, nil
+}
+
+// chainEntry is a stored entry split into its chain fields and the bytes its hash covers.
+type chainEntry struct {
+	seq      int64
+	hash     string
+	prevHash string
+	body     []byte
+	// set once an erasure scrubbed the entry, redactedHash is the hash of what is left
+	redacted     bool
+	redactedHash string
+}
+
+func auditEntry(raw bson.Raw) (chainEntry, error) {
+	var entry chainEntry
+	elements, err := raw.Elements()
+	if err != nil {
+		return entry, err
+	}
+	doc := bson.D{}
+	for _, element := range elements {
+		switch element.Key() {
+		case "_id":
+			continue
+		case "hash":
+			entry.hash, _ = element.Value().StringValueOK()
+			continue
+		case "redacted":
+			entry.redacted, _ = element.Value().BooleanOK()
+			continue
+		case "redacted_hash":
+			entry.redactedHash, _ = element.Value().StringValueOK()
+			continue
+		case "seq":
+			entry.seq, _ = element.Value().AsInt64OK()
+		case "prev_hash":
+			entry.prevHash, _ = element.Value().StringValueOK()
+		}
+		doc = append(doc, bson.E{Key: element.Key(), Value: element.Value()})
+	}
+	entry.body, err = bson.Marshal(doc)
+	return entry, err
+}
+
+// auditRedaction reads the seq and hash an audit.redacted entry vouches for.
+func auditRedaction(raw bson.Raw) (int64, string, bool) {
+	if action, _ := raw.Lookup("action").StringValueOK(); action != "audit.redacted" {
+		return 0, "", false
+	}
+	seq, ok := raw.Lookup("details", "seq").AsInt64OK()
+	hash, hashOK := raw.Lookup("details", "redacted_hash").StringValueOK()
+	return seq, hash, ok && hashOK
+}
+
+// RedactAuditEvents overwrites the fields in set on the entries matching filter, for
+// erasures. The chain can't vouch for a scrubbed entry anymore, so before each one is
+// changed an audit.redacted entry is appended that commits to what will be left of it.
+// An entry that doesn't match its hash is left alone, redacting it would hide that.
+func RedactAuditEvents(ctx context.Context, filter, set bson.D) (int64, error) {
+	cursor, err := auditCollection.Find(ctx, filter, options.Find().SetSort(bson.D{bson.E{Key: "seq", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	var entries []bson.Raw
+	if err := cursor.All(ctx, &entries); err != nil {
+		return 0, err
+	}
+
+	var redacted int64
+	for _, raw := range entries {
+		entry, err := auditEntry(raw)
+		if err != nil {
+			return redacted, err
+		}
+		if entry.redacted {
+			continue
+		}
+		update := append(bson.D{}, set...)
+
+		// entries from before the chain have nothing to keep consistent
+		if entry.seq > 0 {
+			if auditHash(entry.body) != entry.hash {
+				return redacted, fmt.Errorf("audit entry %d does not match its hash, not redacting it", entry.seq)
+			}
+			body, err := redactAuditBody(entry.body, set)
+			if err != nil {
+				return redacted, err
+			}
+			redactedHash := auditHash(body)
+			err = appendAuditEvent(ctx, models.AuditEvent{
+				Action:     "audit.redacted",
+				TargetType: "audit_entry",
+				TargetID:   strconv.FormatInt(entry.seq, 10),
+				Details:    map[string]any{"seq": entry.seq, "redacted_hash": redactedHash},
+				RequestID:  middleware.GetReqID(ctx),
+				CreatedAt:  time.Now(),
+			})
+			if err != nil {
+				return redacted, err
+			}
+			update = append(update,
+				bson.E{Key: "redacted", Value: true},
+				bson.E{Key: "redacted_hash", Value: redactedHash},
+			)
+		}
+
+		_, err = auditCollection.UpdateOne(ctx, bson.D{bson.E{Key: "_id", Value: raw.Lookup("_id")}}, bson.D{
+			bson.E{Key: "$set", Value: update},
+		})
+		if err != nil {
+			return redacted, err
+		}
+		redacted++
+	}
+	return redacted, nil
+}
+
+// redactAuditBody is body as $set will leave it: existing fields are overwritten in
+// place, new ones go at the end.
+func redactAuditBody(body []byte, set bson.D) ([]byte, error) {
+	elements, err := bson.Raw(body).Elements()
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.D{}
+	done := map[string]bool{}
+	for _, element := range elements {
+		var value any = element.Value()
+		for _, field := range set {
+			if field.Key == element.Key() {
+				value = field.Value
+				done[field.Key] = true
+			}
+		}
+		doc = append(doc, bson.E{Key: element.Key(), Value: value})
+	}
+	for _, field := range set {
+		if !done[field.Key] {
+			doc = append(doc, field)
+		}
+	}
+	return bson.Marshal(doc)
+}
+
+// AuditFilter narrows QueryAuditEvents, empty fields match everything.
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	RequestID  string
+	Since      time.Time
+	Until      time.Time
+}
+
+func (f AuditFilter) query() bson.D {
+	query := bson.D{}
+	for _, field := range []struct{ key, value string }{
+		{"actor_id", f.ActorID},
+		{"action", f.Action},
+		{"target_type", f.TargetType},
+		{"target_id", f.TargetID},
+		{"request_id", f.RequestID},
+	} {
+		if field.value != "" {
+			query = append(query, bson.E{Key: field.key, Value: field.value})
+		}
+	}
+	created := bson.D{}
+	if !f.Since.IsZero() {
+		created = append(created, bson.E{Key: "$gte", Value: f.Since})
+	}
+	if !f.Until.IsZero() {
+		created = append(created, bson.E{Key: "$lt", Value: f.Until})
+	}
+	if len(created) > 0 {
+		query = append(query, bson.E{Key: "created_at", Value: created})
+	}
+	return query
+}
+
+// auditReader decodes nested documents (details, before, after) as maps so they come
+// out of the API as plain JSON objects.
+var auditReader, _ = auditCollection.Clone(options.Collection().SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true}))
+
+// QueryAuditEvents returns a page of matching events, newest first, and the total count.
+func QueryAuditEvents(ctx context.Context, filter AuditFilter, skip, limit int64) ([]models.AuditEvent, int64, error) {
+	query := filter.query()
+	total, err := auditReader.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := auditReader.Find(ctx, query, options.Find().
+		SetSort(bson.D{bson.E{Key: "created_at", Value: -1}, bson.E{Key: "seq", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit))
+	if err != nil {
+		return nil, 0, err
+	}
+	events := []models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// StreamAuditEvents calls fn for every matching event, oldest first.
+func StreamAuditEvents(ctx context.Context, filter AuditFilter, fn func(models.AuditEvent) error) error {
+	cursor, err := auditReader.Find(ctx, filter.query(), options.Find().
+		SetSort(bson.D{bson.E{Key: "created_at", Value: 1}, bson.E{Key: "seq", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var event models.AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ClientIP is the address the request came from, without the port.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,28 +1,74 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/models"
 )
 
 type ContextKey string
 
 const (
 	UserID ContextKey = "userId"
-	Role   ContextKey = "role"
-	Email  ContextKey = "email"
+	Roles  ContextKey = "roles"
+	// permissions of Roles, resolved by Auth on every request
+	Permissions ContextKey = "permissions"
+	Email       ContextKey = "email"
+	// how the request authenticated, one of the AuthMethod* values
+	AuthMethod    ContextKey = "authMethod"
+	EmailVerified ContextKey = "emailVerified"
+	MFA           ContextKey = "mfa"
+	// admin acting as UserID, only set for impersonated sessions
+	ImpersonatorID ContextKey = "impersonatorId"
+	// profile named in the token, Profile is the one the request acts as (see ActiveProfile)
+	ProfileID ContextKey = "profileId"
+	Profile   ContextKey = "profile"
+	// how and when (unix seconds) the session signed in, see WithLogin
+	LoginMethod ContextKey = "loginMethod"
+	AuthTime    ContextKey = "authTime"
+)
+
+const (
+	AuthMethodCookie = "cookie"
+	AuthMethodBearer = "bearer"
 )
 
+// ImpersonatorFromContext returns the admin behind an impersonated session, empty otherwise.
+func ImpersonatorFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ImpersonatorID).(string)
+	return id
+}
+
+// ProfileFromContext returns the profile resolved by the ActiveProfile middleware.
+func ProfileFromContext(ctx context.Context) (models.Profile, bool) {
+	profile, ok := ctx.Value(Profile).(models.Profile)
+	return profile, ok
+}
+
+// RecentLogin reports how the session signed in and whether that was less than maxAge ago.
+// Sessions from before logins were recorded are never recent.
+func RecentLogin(ctx context.Context, maxAge time.Duration) (string, bool) {
+	method, _ := ctx.Value(LoginMethod).(string)
+	authTime, _ := ctx.Value(AuthTime).(int64)
+	if authTime == 0 {
+		return method, false
+	}
+	return method, time.Since(time.Unix(authTime, 0)) < maxAge
+}
+
 // Even better use a struct with combination of above consts
 // And keep this file in types than utils
 
-func GetDataFromContext(r *http.Request) (ContextKey, error) {
+func GetDataFromContext(r *http.Request) (string, error) {
 	userId := r.Context().Value(UserID)
 	if userId == nil {
 		return "", errors.New("userid does not exists in context")
 	}
 
-	id, ok := userId.(ContextKey)
+	id, ok := userId.(string)
 
 	if !ok {
 		return "", errors.New("unable to retrive userid")
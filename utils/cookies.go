@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Cookie attributes are shared by every cookie we set so the auth and csrf cookies
+// always agree on SameSite/Domain.
+var (
+	CookieDomain   = GetEnvString("COOKIE_DOMAIN", "")
+	CookieSecure   = GetEnvBool("COOKIE_SECURE", true)
+	CookieSameSite = parseSameSite(GetEnvString("COOKIE_SAMESITE", "none"))
+)
+
+func parseSameSite(v string) http.SameSite {
+	switch strings.ToLower(v) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	default:
+		return http.SameSiteNoneMode
+	}
+}
+
+// SetCookie writes a cookie with the configured attributes. A negative maxAge deletes it.
+func SetCookie(w http.ResponseWriter, name, value string, maxAge int, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: CookieSameSite,
+	})
+}
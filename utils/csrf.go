@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// Double submit: the token lives in a cookie the frontend can read and has to be echoed
+// back in the X-CSRF-Token header. The signature covers the access token of the session
+// it was issued for. A cookie planted from a sibling subdomain only passes if it was
+// issued for the victim's own session, whose access token cookie js can't read.
+var csrfSecret = loadCSRFSecret()
+
+func loadCSRFSecret() []byte {
+	secret := GetEnvString("CSRF_SECRET", os.Getenv("SECRET_KEY"))
+	if secret == "" {
+		log.Fatal("CSRF_SECRET not set in environment")
+	}
+	return []byte(secret)
+}
+
+// GenerateCSRFToken signs a token for the session with access token session, empty
+// before sign in.
+func GenerateCSRFToken(session string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	return nonce + "." + signCSRF(nonce, session), nil
+}
+
+func ValidCSRFToken(cookieToken, headerToken, session string) bool {
+	if cookieToken == "" || session == "" || subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+		return false
+	}
+	nonce, sig, ok := strings.Cut(cookieToken, ".")
+	if !ok {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(signCSRF(nonce, session)))
+}
+
+// IssueCSRFToken generates a token for the session and sets the cookie, the token is
+// returned so it can be handed to the client in the response body too.
+func IssueCSRFToken(w http.ResponseWriter, session string) (string, error) {
+	token, err := GenerateCSRFToken(session)
+	if err != nil {
+		return "", err
+	}
+	SetCookie(w, CSRFCookieName, token, 86400, false) // readable by js on purpose
+	return token, nil
+}
+
+func signCSRF(nonce, session string) string {
+	sessionHash := sha256.Sum256([]byte(session))
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(nonce))
+	mac.Write(sessionHash[:])
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var emailLimitCollection *mongo.Collection = database.OpenCollection("email_limits")
+
+// Kinds of mail that anyone can trigger for any address, each limited on its own.
+const (
+	EmailKindPasswordReset = "password_reset"
+	EmailKindVerification  = "verification"
+	EmailKindMagicLink     = "magic_link"
+)
+
+// AllowEmail counts a mail of kind to email and reports whether it is within max per
+// window. Counting and starting a new window is one update, so concurrent requests
+// can't get past the limit together. Windows longer than a day are cut short by the
+// TTL index.
+func AllowEmail(ctx context.Context, kind, email string, max int, window time.Duration) (bool, error) {
+	now := time.Now()
+	current := bson.D{bson.E{Key: "$gt", Value: bson.A{"$window_start", now.Add(-window)}}}
+	update := mongo.Pipeline{bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "count", Value: bson.D{bson.E{Key: "$cond", Value: bson.A{current, bson.D{bson.E{Key: "$add", Value: bson.A{"$count", 1}}}, 1}}}},
+		bson.E{Key: "window_start", Value: bson.D{bson.E{Key: "$cond", Value: bson.A{current, "$window_start", now}}}},
+	}}}}
+	filter := bson.D{
+		bson.E{Key: "kind", Value: kind},
+		bson.E{Key: "email", Value: normalizeEmail(email)},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var limit models.EmailLimit
+	err := emailLimitCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&limit)
+	if mongo.IsDuplicateKeyError(err) {
+		// two first mails raced on the upsert, the loser counts on the winner's document
+		err = emailLimitCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&limit)
+	}
+	if err != nil {
+		return false, err
+	}
+	return limit.Count <= max, nil
+}
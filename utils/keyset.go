@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one private key of the keyset, the kid is the PEM file name without extension.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.Signer
+	CreatedAt time.Time
+	// when a newer key took over, zero for the active key. Only read or written while
+	// holding the KeySet lock.
+	RetiredAt time.Time
+}
+
+// KeyRetention is how long a key still verifies tokens after it stopped signing them.
+// It has to outlive every token the key signed: refresh tokens and emailed links.
+var KeyRetention = GetEnvDuration("JWT_KEY_RETENTION", 24*time.Hour)
+
+// Expired reports whether the key has been retired for longer than KeyRetention.
+func (k *SigningKey) Expired(now time.Time) bool {
+	return !k.RetiredAt.IsZero() && now.After(k.RetiredAt.Add(KeyRetention))
+}
+
+// KeySet holds the active signing key plus the previous ones, which are only kept to
+// verify tokens that were signed before a rotation, until KeyRetention has passed.
+type KeySet struct {
+	mu         sync.RWMutex
+	dir        string
+	alg        string
+	active     *SigningKey
+	keys       map[string]*SigningKey
+	expired    map[string]bool
+	lastReload time.Time
+}
+
+// Keys is loaded from JWT_KEYS_DIR at startup. With no keys on disk a fresh one is
+// generated (and written back if the directory is writable).
+var Keys = LoadKeySet(GetEnvString("JWT_KEYS_DIR", "keys"), GetEnvString("JWT_SIGNING_ALG", "RS256"), os.Getenv("JWT_ACTIVE_KID"))
+
+func LoadKeySet(dir, alg, activeKid string) *KeySet {
+	ks := &KeySet{dir: dir, alg: alg, keys: map[string]*SigningKey{}, expired: map[string]bool{}}
+	if err := ks.load(); err != nil {
+		log.Printf("could not load signing keys from %s: %v", dir, err)
+	}
+
+	if k, ok := ks.keys[activeKid]; ok {
+		ks.active = k
+	} else {
+		ks.active = ks.newest()
+	}
+
+	if ks.active == nil {
+		if _, err := ks.Rotate(); err != nil {
+			log.Fatalf("could not create signing key: %v", err)
+		}
+	}
+	ks.retire(time.Now())
+	log.Printf("jwt signing key %s (%s) active", ks.active.ID, ks.active.Method.Alg())
+	return ks
+}
+
+func (ks *KeySet) Active() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.active
+}
+
+// Lookup finds a key by kid. An unknown kid triggers a (throttled) re-read of the key
+// directory so keys rotated by another instance sharing the directory are picked up.
+// RetiredAt is written under the lock, so expiry is checked while holding it.
+func (ks *KeySet) Lookup(kid string) (*SigningKey, bool) {
+	now := time.Now()
+	ks.mu.RLock()
+	k, ok := ks.keys[kid]
+	expired := ok && k.Expired(now)
+	stale := now.Sub(ks.lastReload) > 30*time.Second
+	ks.mu.RUnlock()
+	if expired {
+		return nil, false
+	}
+	if ok || !stale {
+		return k, ok
+	}
+
+	ks.mu.Lock()
+	if err := ks.load(); err != nil {
+		log.Printf("could not reload signing keys: %v", err)
+	}
+	ks.retire(now)
+	k, ok = ks.keys[kid]
+	ks.mu.Unlock()
+	return k, ok
+}
+
+// Rotate generates a new key with the configured algorithm and makes it active.
+// The previous key stays in the set for verification until it expires.
+func (ks *KeySet) Rotate() (*SigningKey, error) {
+	var signer crypto.Signer
+	var method jwt.SigningMethod
+	var err error
+
+	switch strings.ToUpper(ks.alg) {
+	case "EDDSA", "ED25519":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+		method = jwt.SigningMethodEdDSA
+	case "RS256":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", ks.alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	key := &SigningKey{
+		ID:        time.Now().UTC().Format("20060102150405") + "-" + hex.EncodeToString(suffix),
+		Method:    method,
+		Private:   signer,
+		CreatedAt: time.Now(),
+	}
+
+	if err := ks.persist(key); err != nil {
+		// still usable, it just won't survive a restart
+		log.Printf("could not write signing key %s: %v", key.ID, err)
+	}
+
+	ks.mu.Lock()
+	if ks.active != nil {
+		ks.active.RetiredAt = key.CreatedAt
+	}
+	ks.keys[key.ID] = key
+	ks.active = key
+	ks.retire(key.CreatedAt)
+	ks.mu.Unlock()
+
+	return key, nil
+}
+
+// Keyfunc is passed to jwt.Parse, it resolves the kid header and makes sure the token
+// alg matches the key it claims to be signed with.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+	key, ok := ks.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("token alg does not match key")
+	}
+	return key.Private.Public(), nil
+}
+
+// JWKS returns the public half of every key that hasn't expired in RFC 7517 format.
+func (ks *KeySet) JWKS() map[string]any {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	keys := []map[string]string{}
+	for _, k := range ks.sorted() {
+		if k.Expired(now) {
+			continue
+		}
+		jwk := map[string]string{
+			"kid": k.ID,
+			"use": "sig",
+			"alg": k.Method.Alg(),
+		}
+		switch pub := k.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]any{"keys": keys}
+}
+
+// load reads every *.pem in the key directory. Caller holds the lock (or owns ks).
+func (ks *KeySet) load() error {
+	ks.lastReload = time.Now()
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+		kid := strings.TrimSuffix(e.Name(), ".pem")
+		if _, ok := ks.keys[kid]; ok || ks.expired[kid] {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(ks.dir, e.Name()))
+		if err != nil {
+			log.Printf("skipping signing key %s: %v", e.Name(), err)
+			continue
+		}
+		key.ID = kid
+		if info, err := e.Info(); err == nil {
+			key.CreatedAt = info.ModTime()
+		}
+		ks.keys[kid] = key
+	}
+	return nil
+}
+
+// retire dates every key older than the active one from when the next key was created,
+// which is when it stopped signing, and drops the expired ones. Their files are left for
+// other instances sharing the directory, load skips them again. Caller holds the lock.
+func (ks *KeySet) retire(now time.Time) {
+	sorted := ks.sorted()
+	for i, k := range sorted {
+		if k == ks.active {
+			break
+		}
+		if k.RetiredAt.IsZero() {
+			k.RetiredAt = sorted[i+1].CreatedAt
+		}
+		if k.Expired(now) {
+			delete(ks.keys, k.ID)
+			ks.expired[k.ID] = true
+		}
+	}
+}
+
+func (ks *KeySet) persist(key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ks.dir, 0o700); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(ks.dir, key.ID+".pem"), data, 0o600)
+}
+
+func (ks *KeySet) newest() *SigningKey {
+	sorted := ks.sorted()
+	if len(sorted) == 0 {
+		return nil
+	}
+	return sorted[len(sorted)-1]
+}
+
+func (ks *KeySet) sorted() []*SigningKey {
+	out := make([]*SigningKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{Method: jwt.SigningMethodRS256, Private: k}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{Method: jwt.SigningMethodEdDSA, Private: k}, nil
+	}
+	return nil, errors.New("only RSA and Ed25519 keys are supported")
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var loginAttemptCollection *mongo.Collection = database.OpenCollection("login_attempts")
+
+// After LOGIN_DELAY_AFTER failures every further attempt has to wait, doubling from
+// LOGIN_BASE_DELAY up to LOGIN_MAX_DELAY. At LOGIN_MAX_ATTEMPTS the account is locked
+// for LOGIN_LOCKOUT_DURATION. Failures older than LOGIN_ATTEMPT_WINDOW are forgotten.
+var (
+	loginDelayAfter      = GetEnvInt("LOGIN_DELAY_AFTER", 3)
+	loginBaseDelay       = GetEnvDuration("LOGIN_BASE_DELAY", time.Second)
+	loginMaxDelay        = GetEnvDuration("LOGIN_MAX_DELAY", time.Minute)
+	loginMaxAttempts     = GetEnvInt("LOGIN_MAX_ATTEMPTS", 10)
+	loginLockoutDuration = GetEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginAttemptWindow   = GetEnvDuration("LOGIN_ATTEMPT_WINDOW", time.Hour)
+)
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// CheckLoginAllowed returns how long the caller has to wait before trying again,
+// zero means the attempt can go ahead.
+func CheckLoginAllowed(ctx context.Context, email string) (time.Duration, error) {
+	var attempt models.LoginAttempt
+	err := loginAttemptCollection.FindOne(ctx, bson.D{{Key: "email", Value: normalizeEmail(email)}}).Decode(&attempt)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if attempt.LockedUntil.After(now) {
+		return attempt.LockedUntil.Sub(now), nil
+	}
+	if attempt.NextAllowedAt.After(now) {
+		return attempt.NextAllowedAt.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// RecordLoginFailure counts a failed attempt and reports whether it locked the account.
+func RecordLoginFailure(ctx context.Context, email string) (bool, error) {
+	email = normalizeEmail(email)
+	now := time.Now()
+
+	// start counting from scratch if the last failure is outside the window
+	_, err := loginAttemptCollection.UpdateOne(ctx, bson.D{
+		{Key: "email", Value: email},
+		{Key: "last_failed_at", Value: bson.D{{Key: "$lt", Value: now.Add(-loginAttemptWindow)}}},
+	}, bson.D{{Key: "$set", Value: bson.D{{Key: "failed_count", Value: 0}}}})
+	if err != nil {
+		return false, err
+	}
+
+	var attempt models.LoginAttempt
+	err = loginAttemptCollection.FindOneAndUpdate(ctx,
+		bson.D{{Key: "email", Value: email}},
+		bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "failed_count", Value: 1}}},
+			{Key: "$set", Value: bson.D{{Key: "last_failed_at", Value: now}}},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+	if err != nil {
+		return false, err
+	}
+
+	set := bson.D{}
+	locked := false
+	if attempt.FailedCount >= loginMaxAttempts {
+		set = append(set, bson.E{Key: "locked_until", Value: now.Add(loginLockoutDuration)}, bson.E{Key: "failed_count", Value: 0})
+		locked = true
+	} else if attempt.FailedCount >= loginDelayAfter {
+		delay := loginBaseDelay << (attempt.FailedCount - loginDelayAfter)
+		if delay <= 0 || delay > loginMaxDelay {
+			delay = loginMaxDelay
+		}
+		set = append(set, bson.E{Key: "next_allowed_at", Value: now.Add(delay)})
+	}
+
+	if len(set) > 0 {
+		if _, err := loginAttemptCollection.UpdateOne(ctx, bson.D{{Key: "email", Value: email}}, bson.D{{Key: "$set", Value: set}}); err != nil {
+			return false, err
+		}
+	}
+	return locked, nil
+}
+
+// ResetLoginFailures clears throttling and any lockout, used on a successful login and by admin unlock.
+func ResetLoginFailures(ctx context.Context, email string) error {
+	_, err := loginAttemptCollection.DeleteOne(ctx, bson.D{{Key: "email", Value: normalizeEmail(email)}})
+	return err
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Chandra5468/movie-streaming/models"
+)
+
+// ratingSystems maps the ratings of each supported system to the youngest age they are
+// suitable for. Profiles are filtered on that age, so ratings from different countries
+// compare with each other.
+var ratingSystems = map[string]map[string]int{
+	// US theatrical
+	"MPAA": {"G": 0, "PG": 8, "PG-13": 13, "R": 17, "NC-17": 18},
+	// US television
+	"TV": {"TV-Y": 0, "TV-Y7": 7, "TV-G": 0, "TV-PG": 8, "TV-14": 14, "TV-MA": 17},
+	// UK
+	"BBFC": {"U": 0, "PG": 8, "12A": 12, "12": 12, "15": 15, "18": 18, "R18": 18},
+	// Germany
+	"FSK": {"0": 0, "6": 6, "12": 12, "16": 16, "18": 18},
+	// Australia
+	"ACB": {"G": 0, "PG": 8, "M": 15, "MA15+": 15, "R18+": 18, "X18+": 18},
+	// India
+	"CBFC": {"U": 0, "UA 7+": 7, "UA 13+": 13, "UA 16+": 16, "A": 18, "S": 18},
+}
+
+// ContentDescriptors are the tags a rating can carry to say why it got its level.
+var ContentDescriptors = []string{
+	"violence", "sexual_content", "nudity", "language", "drug_use", "alcohol",
+	"smoking", "horror", "discrimination", "self_harm", "gambling",
+}
+
+var ErrUnknownRating = errors.New("unknown rating")
+
+// NormalizeMaturity canonicalizes the system and rating, sets the age level and checks
+// the descriptors. Whatever age level the client sent is overwritten.
+func NormalizeMaturity(rating *models.MaturityRating) error {
+	rating.System = strings.ToUpper(strings.TrimSpace(rating.System))
+	rating.Rating = strings.ToUpper(strings.TrimSpace(rating.Rating))
+
+	levels, ok := ratingSystems[rating.System]
+	if !ok {
+		return fmt.Errorf("%w: rating system %s", ErrUnknownRating, rating.System)
+	}
+	age, ok := levels[rating.Rating]
+	if !ok {
+		return fmt.Errorf("%w: %s %s", ErrUnknownRating, rating.System, rating.Rating)
+	}
+	rating.AgeLevel = age
+
+	for i, descriptor := range rating.Descriptors {
+		descriptor = strings.ToLower(strings.TrimSpace(descriptor))
+		if !slices.Contains(ContentDescriptors, descriptor) {
+			return fmt.Errorf("%w: content descriptor %s", ErrUnknownRating, descriptor)
+		}
+		rating.Descriptors[i] = descriptor
+	}
+	slices.Sort(rating.Descriptors)
+	rating.Descriptors = slices.Compact(rating.Descriptors)
+	return nil
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/Chandra5468/movie-streaming/models"
+)
+
+// NormalizeMovieMetadata trims and cases the language and country codes, drops duplicates
+// and turns missing lists into empty ones so every movie has the same shape. It runs before
+// validation, the validate tags expect the canonical form.
+func NormalizeMovieMetadata(metadata *models.MovieMetadata) {
+	metadata.OriginalLanguage = strings.ToLower(strings.TrimSpace(metadata.OriginalLanguage))
+	metadata.SpokenLanguages = normalizeCodes(metadata.SpokenLanguages, strings.ToLower)
+	metadata.ProductionCountries = normalizeCodes(metadata.ProductionCountries, strings.ToUpper)
+	metadata.Tagline = strings.TrimSpace(metadata.Tagline)
+	metadata.Synopsis = strings.TrimSpace(metadata.Synopsis)
+	if metadata.Backdrops == nil {
+		metadata.Backdrops = []string{}
+	}
+	if metadata.ReleaseDate != nil {
+		date := metadata.ReleaseDate.UTC()
+		metadata.ReleaseDate = &date
+	}
+}
+
+func normalizeCodes(codes []string, toCase func(string) string) []string {
+	normalized := []string{}
+	for _, code := range codes {
+		code = toCase(strings.TrimSpace(code))
+		if !slices.Contains(normalized, code) {
+			normalized = append(normalized, code)
+		}
+	}
+	return normalized
+}
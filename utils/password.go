@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes are stored in PHC string format so every hash carries its own algorithm and
+// parameters, e.g. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. bcrypt hashes are
+// already self-describing ($2a$10$...) and are still verified as they are.
+// Bad settings stop the server at startup, argon2 panics on some of them and an unknown
+// algorithm would make every login rehash.
+var (
+	PasswordHashAlgorithm = loadPasswordHashAlgorithm() // argon2id or bcrypt
+	argon2Memory          = uint32(passwordHashSetting("ARGON2_MEMORY_KIB", 64*1024, 8, math.MaxUint32))
+	argon2Iterations      = uint32(passwordHashSetting("ARGON2_ITERATIONS", 3, 1, math.MaxUint32))
+	argon2Parallelism     = uint8(passwordHashSetting("ARGON2_PARALLELISM", 2, 1, math.MaxUint8))
+	argon2SaltLength      = passwordHashSetting("ARGON2_SALT_LENGTH", 16, 8, 1024)
+	argon2KeyLength       = uint32(passwordHashSetting("ARGON2_KEY_LENGTH", 32, 16, 1024))
+	bcryptCost            = passwordHashSetting("BCRYPT_COST", bcrypt.DefaultCost, bcrypt.MinCost, bcrypt.MaxCost)
+)
+
+func loadPasswordHashAlgorithm() string {
+	algorithm := GetEnvString("PASSWORD_HASH_ALGORITHM", "argon2id")
+	if algorithm != "argon2id" && algorithm != "bcrypt" {
+		log.Fatalf("PASSWORD_HASH_ALGORITHM must be argon2id or bcrypt, not %q", algorithm)
+	}
+	return algorithm
+}
+
+func passwordHashSetting(name string, fallback, lo, hi int) int {
+	value := GetEnvInt(name, fallback)
+	if value < lo || value > hi {
+		log.Fatalf("%s must be between %d and %d, not %d", name, lo, hi, value)
+	}
+	return value
+}
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// HashPassword hashes with the configured algorithm and parameters.
+func HashPassword(password string) (string, error) {
+	if PasswordHashAlgorithm == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Iterations, argon2Memory, argon2Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Iterations, argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// VerifyPassword checks password against an encoded hash. needsRehash is true when the
+// hash was made with another algorithm or weaker parameters than currently configured,
+// the caller should then store a fresh HashPassword result.
+func VerifyPassword(encoded, password string) (match bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		p, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, false, err
+		}
+		key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+		if subtle.ConstantTimeCompare(key, p.key) != 1 {
+			return false, false, nil
+		}
+		needsRehash = PasswordHashAlgorithm != "argon2id" ||
+			p.memory != argon2Memory || p.iterations != argon2Iterations ||
+			p.parallelism != argon2Parallelism || uint32(len(p.key)) != argon2KeyLength
+		return true, needsRehash, nil
+
+	case strings.HasPrefix(encoded, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, _ := bcrypt.Cost([]byte(encoded))
+		return true, PasswordHashAlgorithm != "bcrypt" || cost != bcryptCost, nil
+	}
+
+	return false, false, ErrUnknownHashFormat
+}
+
+func decodeArgon2id(encoded string) (*argon2Params, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// reject passwords that contain the email, its local part or the user's names
+	DisallowPersonalInfo bool
+	// directory of the breached password index, empty disables the check
+	BreachedIndexDir string
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:            GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+	MaxLength:            GetEnvInt("PASSWORD_MAX_LENGTH", 128),
+	RequireUpper:         GetEnvBool("PASSWORD_REQUIRE_UPPER", true),
+	RequireLower:         GetEnvBool("PASSWORD_REQUIRE_LOWER", true),
+	RequireDigit:         GetEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+	RequireSymbol:        GetEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+	DisallowPersonalInfo: GetEnvBool("PASSWORD_DISALLOW_PERSONAL_INFO", true),
+	BreachedIndexDir:     GetEnvString("BREACHED_PASSWORDS_DIR", ""),
+}
+
+// Check returns every rule the password breaks, nil means it is acceptable.
+// personal is the user's email and names. Use it for registration and every password change.
+func (p PasswordPolicy) Check(password string, personal ...string) []string {
+	var problems []string
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		problems = append(problems, "password must be at least "+strconv.Itoa(p.MinLength)+" characters")
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, "password must be at most "+strconv.Itoa(p.MaxLength)+" characters")
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "password must contain a symbol")
+	}
+
+	if p.DisallowPersonalInfo && containsPersonalInfo(password, personal) {
+		problems = append(problems, "password must not contain your email or name")
+	}
+
+	if p.BreachedIndexDir != "" {
+		breached, err := IsBreachedPassword(p.BreachedIndexDir, password)
+		if err != nil {
+			// a broken index shouldn't block registrations
+			log.Printf("breached password check failed: %v", err)
+		}
+		if breached {
+			problems = append(problems, "password has appeared in a data breach, choose a different one")
+		}
+	}
+
+	return problems
+}
+
+func containsPersonalInfo(password string, personal []string) bool {
+	lowered := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			candidates = append(candidates, local)
+		}
+		for _, c := range candidates {
+			// very short names would match too much
+			if len(c) >= 3 && strings.Contains(lowered, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsBreachedPassword looks the password up in a local k-anonymity index: the upper case
+// SHA-1 of the password is split into a 5 character prefix, which names the file, and
+// the remaining 35 character suffix, which is listed in that file one per line as
+// "SUFFIX" or "SUFFIX:COUNT" (the same layout as the HIBP range API responses).
+// A missing prefix file means no breached password shares that prefix.
+func IsBreachedPassword(dir, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
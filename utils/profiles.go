@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var profileCollection *mongo.Collection = database.OpenCollection("profiles")
+
+// MaxProfilesPerAccount caps how many profiles one account can have, the default one included.
+var MaxProfilesPerAccount = GetEnvInt("MAX_PROFILES_PER_ACCOUNT", 5)
+
+func GetProfile(ctx context.Context, userId, profileId string) (models.Profile, error) {
+	var profile models.Profile
+	err := profileCollection.FindOne(ctx, bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "profile_id", Value: profileId},
+	}).Decode(&profile)
+	return profile, err
+}
+
+// DefaultProfile returns the account holder's profile. Accounts from before profiles
+// get it on first use, named after the user and with their favourite genres.
+func DefaultProfile(ctx context.Context, userId string) (models.Profile, error) {
+	var profile models.Profile
+	filter := bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "default", Value: true},
+	}
+	err := profileCollection.FindOne(ctx, filter).Decode(&profile)
+	if err != mongo.ErrNoDocuments {
+		return profile, err
+	}
+
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "user_id", Value: userId}}).Decode(&user); err != nil {
+		return profile, err
+	}
+	genres := user.FavouriteGenres
+	if genres == nil {
+		genres = []models.Genre{}
+	}
+
+	// the unique index on default profiles makes concurrent first requests agree on one
+	now := time.Now()
+	err = profileCollection.FindOneAndUpdate(ctx, filter, bson.D{
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "profile_id", Value: primitive.NewObjectID().Hex()},
+			bson.E{Key: "name", Value: user.FirstName},
+			bson.E{Key: "avatar", Value: ""},
+			bson.E{Key: "favourite_genres", Value: genres},
+			bson.E{Key: "maturity_level", Value: models.MaturityAdult},
+			bson.E{Key: "kids", Value: false},
+			bson.E{Key: "created_at", Value: now},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&profile)
+	if mongo.IsDuplicateKeyError(err) {
+		err = profileCollection.FindOne(ctx, filter).Decode(&profile)
+	}
+	return profile, err
+}
+
+// ProfilePINRequired reports whether moving from the session's profile to target needs
+// the account's profile PIN: leaving a kids profile for one that isn't. A profile that
+// was deleted under the session counts as a kids profile.
+func ProfilePINRequired(ctx context.Context, userId, fromProfileId string, target models.Profile) (bool, error) {
+	if target.Kids || fromProfileId == "" || fromProfileId == target.ProfileID {
+		return false, nil
+	}
+	from, err := GetProfile(ctx, userId, fromProfileId)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return from.Kids, nil
+}
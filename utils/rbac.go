@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/singleflight"
+)
+
+var roleCollection *mongo.Collection = database.OpenCollection("roles")
+
+// Roles are read on every authenticated request, so they are cached. Changes made on
+// this instance show up right away, changes made on others within RBAC_CACHE_TTL.
+var roleCacheTTL = GetEnvDuration("RBAC_CACHE_TTL", 30*time.Second)
+
+// Loads run outside the lock and only one at a time, an expired set keeps being served
+// while it refreshes. generation counts invalidations so a load that started before one
+// can't put the old roles back.
+var roleCache struct {
+	mu         sync.RWMutex
+	roles      map[string]models.Role
+	loadedAt   time.Time
+	generation int64
+	loads      singleflight.Group
+}
+
+// roleLoadTimeout bounds a load, it isn't tied to the request that started it
+const roleLoadTimeout = 10 * time.Second
+
+// EnsureRoles creates the built-in roles and moves users from the old single role
+// field to the roles list. Safe to run on every start.
+func EnsureRoles(ctx context.Context) error {
+	now := time.Now()
+	_, err := roleCollection.UpdateOne(ctx, bson.D{bson.E{Key: "name", Value: models.RoleAdmin}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "permissions", Value: models.AllPermissions},
+			bson.E{Key: "built_in", Value: true},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "description", Value: "Full access"},
+			bson.E{Key: "created_at", Value: now},
+		}},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	_, err = roleCollection.UpdateOne(ctx, bson.D{bson.E{Key: "name", Value: models.RoleUser}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "built_in", Value: true}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "description", Value: "Viewer"},
+			bson.E{Key: "permissions", Value: []string{}},
+			bson.E{Key: "created_at", Value: now},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	_, err = userCollection.UpdateMany(ctx, bson.D{
+		bson.E{Key: "roles", Value: bson.D{bson.E{Key: "$exists", Value: false}}},
+		bson.E{Key: "role", Value: bson.D{bson.E{Key: "$exists", Value: true}}},
+	}, mongo.Pipeline{
+		bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "roles", Value: bson.A{"$role"}}}}},
+		bson.D{bson.E{Key: "$unset", Value: "role"}},
+	})
+	InvalidateRoleCache()
+	return err
+}
+
+func InvalidateRoleCache() {
+	roleCache.mu.Lock()
+	roleCache.roles = nil
+	roleCache.generation++
+	roleCache.mu.Unlock()
+}
+
+// AllRoles returns every role by name. Only the first request after a start or an
+// invalidation waits for the database.
+func AllRoles(ctx context.Context) (map[string]models.Role, error) {
+	roleCache.mu.RLock()
+	roles, loadedAt, generation := roleCache.roles, roleCache.loadedAt, roleCache.generation
+	roleCache.mu.RUnlock()
+
+	if roles != nil {
+		if time.Since(loadedAt) >= roleCacheTTL {
+			roleCache.loads.DoChan(strconv.FormatInt(generation, 10), func() (any, error) {
+				return loadRoles(generation)
+			})
+		}
+		return roles, nil
+	}
+
+	result := roleCache.loads.DoChan(strconv.FormatInt(generation, 10), func() (any, error) {
+		return loadRoles(generation)
+	})
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(map[string]models.Role), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadRoles reads the roles and caches them unless the cache was invalidated meanwhile.
+func loadRoles(generation int64) (map[string]models.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), roleLoadTimeout)
+	defer cancel()
+
+	cursor, err := roleCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var list []models.Role
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string]models.Role, len(list))
+	for _, role := range list {
+		roles[role.Name] = role
+	}
+
+	roleCache.mu.Lock()
+	if roleCache.generation == generation {
+		roleCache.roles = roles
+		roleCache.loadedAt = time.Now()
+	}
+	roleCache.mu.Unlock()
+	return roles, nil
+}
+
+// ResolvePermissions is the union of the permissions of the given roles. Roles that
+// don't exist (anymore) grant nothing.
+func ResolvePermissions(ctx context.Context, roleNames []string) ([]string, error) {
+	roles, err := AllRoles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := []string{}
+	for _, name := range roleNames {
+		for _, perm := range roles[name].Permissions {
+			if !slices.Contains(permissions, perm) {
+				permissions = append(permissions, perm)
+			}
+		}
+	}
+	slices.Sort(permissions)
+	return permissions, nil
+}
+
+// HasPermission reports whether Auth resolved perm for the request.
+func HasPermission(ctx context.Context, perm string) bool {
+	permissions, _ := ctx.Value(Permissions).([]string)
+	return slices.Contains(permissions, perm)
+}
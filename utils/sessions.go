@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Chandra5468/movie-streaming/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/sync/singleflight"
+)
+
+// RevokeUserSessions logs the user out everywhere: stored tokens are cleared and every
+// token issued before now stops working, access tokens through CheckSession.
+func RevokeUserSessions(ctx context.Context, userId string) error {
+	now := time.Now()
+	_, err := userCollection.UpdateOne(ctx, bson.D{bson.E{Key: "user_id", Value: userId}}, bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "token", Value: ""},
+			bson.E{Key: "refresh_token", Value: ""},
+			bson.E{Key: "sessions_revoked_at", Value: now},
+			bson.E{Key: "updated_at", Value: now},
+		}},
+	})
+	InvalidateSessionCache(userId)
+	return err
+}
+
+var (
+	ErrAccountDisabled = errors.New("account has been disabled")
+	ErrSessionRevoked  = errors.New("session has been revoked")
+)
+
+// Auth checks every access token against the user's account, so the account is cached
+// like the roles: changes made on this instance apply right away, changes made on
+// others within SESSION_CACHE_TTL.
+var sessionCacheTTL = GetEnvDuration("SESSION_CACHE_TTL", 30*time.Second)
+
+// the cache is swept of expired entries once it holds this many users
+const sessionCacheSweepAt = 10000
+
+type sessionStatus struct {
+	missing   bool
+	disabled  bool
+	revokedAt time.Time
+	loadedAt  time.Time
+}
+
+var sessionCache = struct {
+	mu         sync.RWMutex
+	users      map[string]sessionStatus
+	generation int64
+	loads      singleflight.Group
+}{users: map[string]sessionStatus{}}
+
+func InvalidateSessionCache(userId string) {
+	sessionCache.mu.Lock()
+	delete(sessionCache.users, userId)
+	sessionCache.generation++
+	sessionCache.mu.Unlock()
+}
+
+// CheckSession returns ErrAccountDisabled or ErrSessionRevoked when a token issued to
+// the user at issuedAt mustn't be used anymore. Deleted users count as revoked.
+func CheckSession(ctx context.Context, userId string, issuedAt time.Time) error {
+	status, err := loadSessionStatus(ctx, userId)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status.missing:
+		return ErrSessionRevoked
+	case status.disabled:
+		return ErrAccountDisabled
+	// iat only has second precision
+	case !status.revokedAt.IsZero() && issuedAt.Before(status.revokedAt.Truncate(time.Second)):
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+func loadSessionStatus(ctx context.Context, userId string) (sessionStatus, error) {
+	sessionCache.mu.RLock()
+	status, ok := sessionCache.users[userId]
+	generation := sessionCache.generation
+	sessionCache.mu.RUnlock()
+	if ok && time.Since(status.loadedAt) < sessionCacheTTL {
+		return status, nil
+	}
+
+	result := sessionCache.loads.DoChan(userId+"/"+strconv.FormatInt(generation, 10), func() (any, error) {
+		return fetchSessionStatus(userId, generation)
+	})
+	select {
+	case res := <-result:
+		if res.Err != nil {
+			return sessionStatus{}, res.Err
+		}
+		return res.Val.(sessionStatus), nil
+	case <-ctx.Done():
+		return sessionStatus{}, ctx.Err()
+	}
+}
+
+// fetchSessionStatus reads the account and caches it unless the cache was invalidated meanwhile.
+func fetchSessionStatus(userId string, generation int64) (sessionStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), roleLoadTimeout)
+	defer cancel()
+
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.D{bson.E{Key: "user_id", Value: userId}},
+		options.FindOne().SetProjection(bson.D{
+			bson.E{Key: "disabled_at", Value: 1},
+			bson.E{Key: "sessions_revoked_at", Value: 1},
+		}),
+	).Decode(&user)
+	status := sessionStatus{loadedAt: time.Now()}
+	switch {
+	case err == mongo.ErrNoDocuments:
+		status.missing = true
+	case err != nil:
+		return status, err
+	default:
+		status.disabled = user.DisabledAt != nil
+		if user.SessionsRevokedAt != nil {
+			status.revokedAt = *user.SessionsRevokedAt
+		}
+	}
+
+	sessionCache.mu.Lock()
+	if sessionCache.generation == generation {
+		if len(sessionCache.users) >= sessionCacheSweepAt {
+			for id, cached := range sessionCache.users {
+				if time.Since(cached.loadedAt) >= sessionCacheTTL {
+					delete(sessionCache.users, id)
+				}
+			}
+		}
+		sessionCache.users[userId] = status
+	}
+	sessionCache.mu.Unlock()
+	return status, nil
+}
+
+// NewOpaqueToken returns a random url safe token and the hex sha256 that should be stored in its place.
+func NewOpaqueToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -2,12 +2,12 @@ package utils
 
 import (
 	"errors"
-	"os"
 	"time"
 
 	"context"
 
 	"github.com/Chandra5468/movie-streaming/database"
+	"github.com/Chandra5468/movie-streaming/models"
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -17,22 +17,83 @@ type SignedDetails struct {
 	Email     string
 	FirstName string
 	LastName  string
-	Role      string
+	Roles     []string
 	UserId    string
+	TokenType string // access, refresh or one of the single purpose types below, all signed with the same keyset
+	// false until the user followed the verification link, legacy accounts count as verified
+	EmailVerified bool
+	// the session was established with a second factor (totp or recovery code)
+	MFA bool
+	// set when an admin signs in as UserId, see GenerateImpersonationToken
+	ImpersonatorID string `json:",omitempty"`
+	// viewing profile picked with POST /api/profiles/{id}/select, empty for the default one
+	ProfileID string `json:",omitempty"`
+	// when (unix seconds) and how the user signed in, refreshes keep it so handlers can
+	// ask for a recent login
+	AuthTime    int64  `json:",omitempty"`
+	LoginMethod string `json:",omitempty"`
 	jwt.RegisteredClaims
 }
 
-var SECRET_KEY = os.Getenv("SECRET_KEY")
-var SECRET_REFRESH_KEY = os.Getenv("SECRET_REFRESH_KEY")
+// TokenOption sets session attributes that don't come from the user document.
+// Options apply to both the access and the refresh token so they survive a refresh.
+type TokenOption func(*SignedDetails)
+
+func WithMFA(mfa bool) TokenOption {
+	return func(c *SignedDetails) { c.MFA = mfa }
+}
+
+func WithProfile(profileId string) TokenOption {
+	return func(c *SignedDetails) { c.ProfileID = profileId }
+}
+
+// WithLogin marks a session the user just signed in to with method, one of the LoginMethod* values.
+func WithLogin(method string) TokenOption {
+	return WithLoginAt(method, time.Now().Unix())
+}
+
+// WithLoginAt keeps the login of the session a new token pair replaces.
+func WithLoginAt(method string, authTime int64) TokenOption {
+	return func(c *SignedDetails) {
+		c.LoginMethod = method
+		c.AuthTime = authTime
+	}
+}
+
+// KeepLogin is WithLoginAt for the session of the request.
+func KeepLogin(ctx context.Context) TokenOption {
+	method, _ := ctx.Value(LoginMethod).(string)
+	authTime, _ := ctx.Value(AuthTime).(int64)
+	return WithLoginAt(method, authTime)
+}
+
+const (
+	LoginMethodPassword  = "password"
+	LoginMethodTOTP      = "totp"
+	LoginMethodPasskey   = "passkey"
+	LoginMethodOIDC      = "oidc"
+	LoginMethodMagicLink = "magic_link"
+)
+
+const (
+	AccessTokenType            = "access"
+	RefreshTokenType           = "refresh"
+	EmailVerificationTokenType = "email_verification"
+	MFAChallengeTokenType      = "mfa_challenge"
+	MagicLinkTokenType         = "magic_link"
+)
+
 var userCollection *mongo.Collection = database.OpenCollection("users")
 
-func GenerateAllTokens(email, firstName, lastName, role, userId string) (JWTtkn string, refreshTkn string, err error) {
+func GenerateAllTokens(user models.User, opts ...TokenOption) (JWTtkn string, refreshTkn string, err error) {
 	claims := &SignedDetails{
-		Email:     email,
-		FirstName: firstName,
-		LastName:  lastName,
-		Role:      role,
-		UserId:    userId,
+		Email:         user.Email,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		Roles:         user.Roles,
+		UserId:        user.UserID,
+		TokenType:     AccessTokenType,
+		EmailVerified: user.IsEmailVerified(),
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "Magic-Moive-Stream",
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -40,19 +101,23 @@ func GenerateAllTokens(email, firstName, lastName, role, userId string) (JWTtkn
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(SECRET_KEY))
+	for _, opt := range opts {
+		opt(claims)
+	}
+
+	signedToken, err := SignClaims(claims)
 
 	if err != nil {
 		return "", "", err
 	}
 
 	refreshClaims := &SignedDetails{
-		Email:     email,
-		FirstName: firstName,
-		LastName:  lastName,
-		Role:      role,
-		UserId:    userId,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Roles:     user.Roles,
+		UserId:    user.UserID,
+		TokenType: RefreshTokenType,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer:    "Magic-Moive-Stream",
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -60,8 +125,11 @@ func GenerateAllTokens(email, firstName, lastName, role, userId string) (JWTtkn
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	signedRefreshToken, err := refreshToken.SignedString([]byte(SECRET_REFRESH_KEY))
+	for _, opt := range opts {
+		opt(refreshClaims)
+	}
+
+	signedRefreshToken, err := SignClaims(refreshClaims)
 
 	if err != nil {
 		return "", "", err
@@ -70,10 +138,56 @@ func GenerateAllTokens(email, firstName, lastName, role, userId string) (JWTtkn
 	return signedToken, signedRefreshToken, nil
 }
 
-func UpdateAllTokens(userId, token, refreshToken string) (err error) {
-	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
+// GenerateImpersonationToken signs an access token for user on behalf of the admin
+// impersonatorId. There is no refresh token, the session ends when it expires.
+func GenerateImpersonationToken(user models.User, impersonatorId string, ttl time.Duration) (string, error) {
+	return SignClaims(&SignedDetails{
+		Email:          user.Email,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		Roles:          user.Roles,
+		UserId:         user.UserID,
+		TokenType:      AccessTokenType,
+		EmailVerified:  user.IsEmailVerified(),
+		ImpersonatorID: impersonatorId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "Magic-Moive-Stream",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	})
+}
 
+// GeneratePurposeToken signs a short lived token that is only good for one flow
+// (e.g. the email verification link), ValidatePurposeToken rejects it for any other.
+func GeneratePurposeToken(tokenType, userId, email string, ttl time.Duration) (string, error) {
+	return SignClaims(&SignedDetails{
+		Email:     email,
+		UserId:    userId,
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "Magic-Moive-Stream",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	})
+}
+
+func ValidatePurposeToken(tokenString, tokenType string) (*SignedDetails, error) {
+	claims := &SignedDetails{}
+
+	if err := ParseClaims(tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, errors.New("token is not valid for this purpose")
+	}
+
+	return claims, nil
+}
+
+func UpdateAllTokens(ctx context.Context, userId, token, refreshToken string) (err error) {
 	updateAt, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
 
 	updateData := bson.D{
@@ -95,23 +209,34 @@ func UpdateAllTokens(userId, token, refreshToken string) (err error) {
 	return nil
 }
 
-func ValidateToken(tokenString string) (*SignedDetails, error) {
-	claims := &SignedDetails{}
+// SignClaims signs with the active key of the keyset and sets the kid header
+// so verifiers can pick the right public key from the JWKS.
+func SignClaims(claims jwt.Claims) (string, error) {
+	key := Keys.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
-		return []byte(SECRET_KEY), nil
-	})
+// ParseClaims verifies the signature against the keyset. Only asymmetric algs are
+// accepted, an HS256 token signed with a public key as secret is rejected up front.
+func ParseClaims(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, Keys.Keyfunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	return err
+}
 
-	if err != nil {
-		return nil, err
-	}
+func ValidateToken(tokenString string) (*SignedDetails, error) {
+	claims := &SignedDetails{}
 
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok { // This is to avoid token spoofing by attackers
+	if err := ParseClaims(tokenString, claims); err != nil {
 		return nil, err
 	}
 
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		return nil, errors.New("token has expired")
+	if claims.TokenType != AccessTokenType {
+		return nil, errors.New("not an access token")
 	}
 
 	return claims, nil
@@ -120,20 +245,12 @@ func ValidateToken(tokenString string) (*SignedDetails, error) {
 func ValidateRefreshToken(tokenString string) (SignedDetails, error) {
 	claims := SignedDetails{}
 
-	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
-		return []byte(SECRET_REFRESH_KEY), nil
-	})
-
-	if err != nil {
-		return SignedDetails{}, err
-	}
-
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	if err := ParseClaims(tokenString, &claims); err != nil {
 		return SignedDetails{}, err
 	}
 
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		return SignedDetails{}, errors.New("refresh token has expired")
+	if claims.TokenType != RefreshTokenType {
+		return SignedDetails{}, errors.New("not a refresh token")
 	}
 
 	return claims, nil
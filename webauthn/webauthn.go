@@ -0,0 +1,395 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Relying party side of the WebAuthn ceremonies (https://www.w3.org/TR/webauthn-2/).
+// We ask for "none" attestation, so the verifier checks the credential itself but does
+// not try to establish trust in the authenticator model. Everything here is pure, the
+// challenge storage lives with the caller, which keeps it easy to drive from tests with
+// a software authenticator.
+
+type Config struct {
+	RPID    string   // the domain, e.g. "example.com"
+	RPName  string   // shown by the browser
+	Origins []string // full origins allowed in clientDataJSON, e.g. "https://app.example.com"
+	// reject assertions without the UV flag (biometric / pin on the authenticator)
+	RequireUserVerification bool
+	Timeout                 time.Duration
+}
+
+var (
+	ErrChallengeMismatch = errors.New("webauthn: challenge mismatch")
+	ErrOriginNotAllowed  = errors.New("webauthn: origin not allowed")
+	ErrRPIDMismatch      = errors.New("webauthn: rp id hash mismatch")
+	ErrUserNotPresent    = errors.New("webauthn: user presence flag not set")
+	ErrUserNotVerified   = errors.New("webauthn: user verification flag not set")
+	ErrSignCount         = errors.New("webauthn: signature counter did not increase, credential may be cloned")
+)
+
+var b64 = base64.RawURLEncoding
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Options sent to navigator.credentials.create / get. Binary values are base64url,
+// the same shape PublicKeyCredential.parseCreationOptionsFromJSON expects.
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int                    `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+func (c Config) userVerification() string {
+	if c.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+// CreationOptions builds registration options. userHandle is an opaque, stable id for
+// the user, exclude lists credential ids the user already registered.
+func (c Config) CreationOptions(challenge, userHandle []byte, name, displayName string, exclude [][]byte) CreationOptions {
+	var o CreationOptions
+	o.Challenge = b64.EncodeToString(challenge)
+	o.RP.ID = c.RPID
+	o.RP.Name = c.RPName
+	o.User.ID = b64.EncodeToString(userHandle)
+	o.User.Name = name
+	o.User.DisplayName = displayName
+	for _, alg := range SupportedAlgorithms {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{"public-key", alg})
+	}
+	o.Timeout = int(c.Timeout.Milliseconds())
+	o.ExcludeCredentials = descriptors(exclude)
+	o.AuthenticatorSelection.ResidentKey = "preferred" // discoverable so login works without typing an email
+	o.AuthenticatorSelection.UserVerification = c.userVerification()
+	o.Attestation = "none"
+	return o
+}
+
+// RequestOptions builds login options. An empty allow list lets the authenticator
+// offer any discoverable credential for this RP.
+func (c Config) RequestOptions(challenge []byte, allow [][]byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        b64.EncodeToString(challenge),
+		Timeout:          int(c.Timeout.Milliseconds()),
+		RPID:             c.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: c.userVerification(),
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	out := []CredentialDescriptor{}
+	for _, id := range ids {
+		out = append(out, CredentialDescriptor{Type: "public-key", ID: b64.EncodeToString(id)})
+	}
+	return out
+}
+
+// Responses as produced by PublicKeyCredential.toJSON().
+
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is what has to be stored after a successful registration.
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte // COSE_Key encoding, feed it back to VerifyAssertion
+	SignCount    uint32
+	AAGUID       []byte
+	UserVerified bool
+	Transports   []string
+}
+
+type AssertionResult struct {
+	CredentialID []byte
+	UserHandle   []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+func (c Config) VerifyRegistration(challenge []byte, resp RegistrationResponse) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: unexpected credential type")
+	}
+	clientData, err := b64.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: clientDataJSON: %w", err)
+	}
+	if err := c.verifyClientData(clientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	attObjBytes, err := b64.DecodeString(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: attestationObject: %w", err)
+	}
+	decoded, _, err := decodeCBOR(attObjBytes)
+	if err != nil {
+		return nil, err
+	}
+	attObj, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.New("webauthn: attestation object is not a map")
+	}
+	format, _ := attObj["fmt"].(string)
+	authData, _ := attObj["authData"].([]byte)
+	attStmt, _ := attObj["attStmt"].(map[any]any)
+
+	parsed, err := c.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.flags&flagAttested == 0 {
+		return nil, errors.New("webauthn: no attested credential data")
+	}
+
+	rawID, err := b64.DecodeString(resp.RawID)
+	if err != nil || !bytes.Equal(rawID, parsed.credentialID) {
+		return nil, errors.New("webauthn: credential id mismatch")
+	}
+
+	pub, err := ParsePublicKey(parsed.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "none":
+	case "packed":
+		// self attestation is signed with the credential key itself and can be checked
+		// without a trust store. Full attestation (x5c) is accepted without evaluating
+		// the certificate chain since we asked for none.
+		if _, hasX5C := attStmt["x5c"]; !hasX5C {
+			alg, _ := attStmt["alg"].(int64)
+			sig, _ := attStmt["sig"].([]byte)
+			if int(alg) != pub.Algorithm {
+				return nil, errors.New("webauthn: attestation alg does not match credential key")
+			}
+			clientDataHash := sha256.Sum256(clientData)
+			if err := pub.Verify(append(append([]byte{}, authData...), clientDataHash[:]...), sig); err != nil {
+				return nil, fmt.Errorf("webauthn: self attestation: %w", err)
+			}
+		}
+	default:
+		// same reasoning as x5c above, the statement is not evaluated
+	}
+
+	return &Credential{
+		ID:           parsed.credentialID,
+		PublicKey:    parsed.publicKey,
+		SignCount:    parsed.signCount,
+		AAGUID:       parsed.aaguid,
+		UserVerified: parsed.flags&flagUserVerified != 0,
+		Transports:   resp.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion checks a login response against the stored credential key and counter.
+func (c Config) VerifyAssertion(challenge []byte, resp AssertionResponse, storedKey []byte, storedSignCount uint32) (*AssertionResult, error) {
+	if resp.Type != "public-key" {
+		return nil, errors.New("webauthn: unexpected credential type")
+	}
+	clientData, err := b64.DecodeString(resp.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: clientDataJSON: %w", err)
+	}
+	if err := c.verifyClientData(clientData, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+
+	authData, err := b64.DecodeString(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: authenticatorData: %w", err)
+	}
+	parsed, err := c.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := b64.DecodeString(resp.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: signature: %w", err)
+	}
+	pub, err := ParsePublicKey(storedKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData)
+	if err := pub.Verify(append(append([]byte{}, authData...), clientDataHash[:]...), sig); err != nil {
+		return nil, err
+	}
+
+	// authenticators that don't keep a counter always send 0
+	if (parsed.signCount != 0 || storedSignCount != 0) && parsed.signCount <= storedSignCount {
+		return nil, ErrSignCount
+	}
+
+	credentialID, err := b64.DecodeString(resp.RawID)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: rawId: %w", err)
+	}
+	var userHandle []byte
+	if resp.Response.UserHandle != "" {
+		if userHandle, err = b64.DecodeString(resp.Response.UserHandle); err != nil {
+			return nil, fmt.Errorf("webauthn: userHandle: %w", err)
+		}
+	}
+
+	return &AssertionResult{
+		CredentialID: credentialID,
+		UserHandle:   userHandle,
+		SignCount:    parsed.signCount,
+		UserVerified: parsed.flags&flagUserVerified != 0,
+	}, nil
+}
+
+func (c Config) verifyClientData(raw []byte, wantType string, challenge []byte) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("webauthn: clientDataJSON: %w", err)
+	}
+	if cd.Type != wantType {
+		return fmt.Errorf("webauthn: unexpected client data type %q", cd.Type)
+	}
+	got, err := b64.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+	for _, origin := range c.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return ErrOriginNotAllowed
+}
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+func (c Config) parseAuthData(data []byte) (*authData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if subtle.ConstantTimeCompare(data[:32], rpIDHash[:]) != 1 {
+		return nil, ErrRPIDMismatch
+	}
+
+	ad := &authData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if c.RequireUserVerification && ad.flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+
+	if ad.flags&flagAttested != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested credential data too short")
+		}
+		ad.aaguid = append([]byte(nil), rest[:16]...)
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("webauthn: credential id truncated")
+		}
+		ad.credentialID = append([]byte(nil), rest[:idLen]...)
+		rest = rest[idLen:]
+		// the key is followed by extensions (if any), only take the bytes of the key itself
+		_, used, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("webauthn: credential public key: %w", err)
+		}
+		ad.publicKey = append([]byte(nil), rest[:used]...)
+	}
+	return ad, nil
+}
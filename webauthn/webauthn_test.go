@@ -0,0 +1,459 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+var testConfig = Config{
+	RPID:    testRPID,
+	RPName:  "Test",
+	Origins: []string{testOrigin},
+	Timeout: time.Minute,
+}
+
+// softAuthenticator plays the browser and the authenticator. It signs whatever it is
+// told to, the fields are public so tests can make it misbehave.
+type softAuthenticator struct {
+	alg          int
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+
+	rpID   string
+	origin string
+	flags  byte
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{
+		alg:          alg,
+		credentialID: randomBytes(t, 16),
+		userHandle:   []byte("user-1"),
+		rpID:         testRPID,
+		origin:       testOrigin,
+		flags:        flagUserPresent | flagUserVerified,
+	}
+	var err error
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.alg == AlgEdDSA {
+		return cborEncode([]cborPair{
+			{1, 1}, {3, AlgEdDSA}, {-1, 6}, {-2, []byte(a.edKey.Public().(ed25519.PublicKey))},
+		})
+	}
+	point := make([]byte, 64)
+	a.ecKey.X.FillBytes(point[:32])
+	a.ecKey.Y.FillBytes(point[32:])
+	return cborEncode([]cborPair{
+		{1, 2}, {3, AlgES256}, {-1, 1}, {-2, point[:32]}, {-3, point[32:]},
+	})
+}
+
+func (a *softAuthenticator) sign(data []byte) []byte {
+	if a.alg == AlgEdDSA {
+		return ed25519.Sign(a.edKey, data)
+	}
+	digest := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	raw, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": b64.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return raw
+}
+
+// register answers navigator.credentials.create, format is "none" or "packed" (self attestation).
+func (a *softAuthenticator) register(challenge []byte, format string) RegistrationResponse {
+	clientData := a.clientData("webauthn.create", challenge)
+	authData := a.authData(true)
+
+	attStmt := []cborPair{}
+	if format == "packed" {
+		clientDataHash := sha256.Sum256(clientData)
+		attStmt = []cborPair{
+			{"alg", a.alg},
+			{"sig", a.sign(append(append([]byte{}, authData...), clientDataHash[:]...))},
+		}
+	}
+
+	var resp RegistrationResponse
+	resp.ID = b64.EncodeToString(a.credentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = b64.EncodeToString(clientData)
+	resp.Response.AttestationObject = b64.EncodeToString(cborEncode([]cborPair{
+		{"fmt", format}, {"attStmt", attStmt}, {"authData", authData},
+	}))
+	resp.Response.Transports = []string{"internal"}
+	return resp
+}
+
+// login answers navigator.credentials.get, the counter goes up like on a real authenticator.
+func (a *softAuthenticator) login(challenge []byte) AssertionResponse {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(false)
+	clientDataHash := sha256.Sum256(clientData)
+
+	var resp AssertionResponse
+	resp.ID = b64.EncodeToString(a.credentialID)
+	resp.RawID = resp.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = b64.EncodeToString(clientData)
+	resp.Response.AuthenticatorData = b64.EncodeToString(authData)
+	resp.Response.Signature = b64.EncodeToString(a.sign(append(append([]byte{}, authData...), clientDataHash[:]...)))
+	resp.Response.UserHandle = b64.EncodeToString(a.userHandle)
+	return resp
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		alg    int
+		format string
+	}{
+		{"ES256 none", AlgES256, "none"},
+		{"ES256 packed", AlgES256, "packed"},
+		{"EdDSA none", AlgEdDSA, "none"},
+		{"EdDSA packed", AlgEdDSA, "packed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := newSoftAuthenticator(t, test.alg)
+
+			challenge := randomBytes(t, 32)
+			credential, err := testConfig.VerifyRegistration(challenge, authenticator.register(challenge, test.format))
+			if err != nil {
+				t.Fatalf("VerifyRegistration: %v", err)
+			}
+			if string(credential.ID) != string(authenticator.credentialID) {
+				t.Errorf("credential id = %x, want %x", credential.ID, authenticator.credentialID)
+			}
+			if !credential.UserVerified {
+				t.Error("credential not marked user verified")
+			}
+
+			signCount := credential.SignCount
+			for range 2 {
+				challenge = randomBytes(t, 32)
+				result, err := testConfig.VerifyAssertion(challenge, authenticator.login(challenge), credential.PublicKey, signCount)
+				if err != nil {
+					t.Fatalf("VerifyAssertion: %v", err)
+				}
+				if result.SignCount != authenticator.signCount {
+					t.Errorf("sign count = %d, want %d", result.SignCount, authenticator.signCount)
+				}
+				if string(result.UserHandle) != "user-1" {
+					t.Errorf("user handle = %q", result.UserHandle)
+				}
+				if !result.UserVerified {
+					t.Error("assertion not marked user verified")
+				}
+				signCount = result.SignCount
+			}
+		})
+	}
+}
+
+func TestLoginWithoutUserVerification(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgES256)
+	challenge := randomBytes(t, 32)
+	credential, err := testConfig.VerifyRegistration(challenge, authenticator.register(challenge, "none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator.flags = flagUserPresent
+	challenge = randomBytes(t, 32)
+	result, err := testConfig.VerifyAssertion(challenge, authenticator.login(challenge), credential.PublicKey, credential.SignCount)
+	if err != nil {
+		t.Fatalf("VerifyAssertion: %v", err)
+	}
+	// callers must not treat this login as a second factor
+	if result.UserVerified {
+		t.Error("assertion without UV flag marked user verified")
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	for _, alg := range []int{AlgES256, AlgEdDSA} {
+		for _, test := range []struct {
+			name   string
+			config Config
+			setup  func(a *softAuthenticator)
+			mutate func(challenge []byte, resp *RegistrationResponse)
+			want   error
+		}{
+			{
+				name: "wrong challenge",
+				mutate: func(challenge []byte, resp *RegistrationResponse) {
+					challenge[0] ^= 0xff
+				},
+				want: ErrChallengeMismatch,
+			},
+			{
+				name:  "wrong origin",
+				setup: func(a *softAuthenticator) { a.origin = "https://evil.example.net" },
+				want:  ErrOriginNotAllowed,
+			},
+			{
+				name:  "wrong rp id",
+				setup: func(a *softAuthenticator) { a.rpID = "evil.example.net" },
+				want:  ErrRPIDMismatch,
+			},
+			{
+				name:   "user verification required",
+				config: Config{RequireUserVerification: true},
+				setup:  func(a *softAuthenticator) { a.flags = flagUserPresent },
+				want:   ErrUserNotVerified,
+			},
+			{
+				name:  "user not present",
+				setup: func(a *softAuthenticator) { a.flags = 0 },
+				want:  ErrUserNotPresent,
+			},
+		} {
+			t.Run(algName(alg)+" "+test.name, func(t *testing.T) {
+				config := testConfig
+				config.RequireUserVerification = test.config.RequireUserVerification
+				authenticator := newSoftAuthenticator(t, alg)
+				if test.setup != nil {
+					test.setup(authenticator)
+				}
+
+				challenge := randomBytes(t, 32)
+				resp := authenticator.register(challenge, "packed")
+				if test.mutate != nil {
+					test.mutate(challenge, &resp)
+				}
+				if _, err := config.VerifyRegistration(challenge, resp); !errors.Is(err, test.want) {
+					t.Fatalf("VerifyRegistration error = %v, want %v", err, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	for _, alg := range []int{AlgES256, AlgEdDSA} {
+		for _, test := range []struct {
+			name   string
+			config Config
+			setup  func(a *softAuthenticator)
+			mutate func(challenge []byte, resp *AssertionResponse, storedCount *uint32)
+			want   error // nil means any error
+		}{
+			{
+				name: "wrong challenge",
+				mutate: func(challenge []byte, resp *AssertionResponse, storedCount *uint32) {
+					challenge[0] ^= 0xff
+				},
+				want: ErrChallengeMismatch,
+			},
+			{
+				name:  "wrong origin",
+				setup: func(a *softAuthenticator) { a.origin = "https://evil.example.net" },
+				want:  ErrOriginNotAllowed,
+			},
+			{
+				name:  "wrong rp id hash",
+				setup: func(a *softAuthenticator) { a.rpID = "evil.example.net" },
+				want:  ErrRPIDMismatch,
+			},
+			{
+				name: "sign count regression",
+				mutate: func(challenge []byte, resp *AssertionResponse, storedCount *uint32) {
+					*storedCount = 10
+				},
+				want: ErrSignCount,
+			},
+			{
+				name:  "sign count replayed",
+				setup: func(a *softAuthenticator) { a.signCount = 4 },
+				mutate: func(challenge []byte, resp *AssertionResponse, storedCount *uint32) {
+					*storedCount = 5
+				},
+				want: ErrSignCount,
+			},
+			{
+				name:   "user verification required",
+				config: Config{RequireUserVerification: true},
+				setup:  func(a *softAuthenticator) { a.flags = flagUserPresent },
+				want:   ErrUserNotVerified,
+			},
+			{
+				name: "tampered signature",
+				mutate: func(challenge []byte, resp *AssertionResponse, storedCount *uint32) {
+					sig, _ := b64.DecodeString(resp.Response.Signature)
+					sig[len(sig)-1] ^= 0x01
+					resp.Response.Signature = b64.EncodeToString(sig)
+				},
+			},
+			{
+				name: "tampered authenticator data",
+				mutate: func(challenge []byte, resp *AssertionResponse, storedCount *uint32) {
+					// claim user verification the authenticator never signed for
+					data, _ := b64.DecodeString(resp.Response.AuthenticatorData)
+					data[32] ^= flagUserVerified
+					resp.Response.AuthenticatorData = b64.EncodeToString(data)
+				},
+			},
+		} {
+			t.Run(algName(alg)+" "+test.name, func(t *testing.T) {
+				config := testConfig
+				config.RequireUserVerification = test.config.RequireUserVerification
+				authenticator := newSoftAuthenticator(t, alg)
+
+				challenge := randomBytes(t, 32)
+				credential, err := testConfig.VerifyRegistration(challenge, authenticator.register(challenge, "none"))
+				if err != nil {
+					t.Fatalf("VerifyRegistration: %v", err)
+				}
+
+				if test.setup != nil {
+					test.setup(authenticator)
+				}
+				challenge = randomBytes(t, 32)
+				resp := authenticator.login(challenge)
+				storedCount := credential.SignCount
+				if test.mutate != nil {
+					test.mutate(challenge, &resp, &storedCount)
+				}
+
+				_, err = config.VerifyAssertion(challenge, resp, credential.PublicKey, storedCount)
+				if err == nil {
+					t.Fatal("VerifyAssertion accepted the assertion")
+				}
+				if test.want != nil && !errors.Is(err, test.want) {
+					t.Fatalf("VerifyAssertion error = %v, want %v", err, test.want)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAssertionWrongKey(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgEdDSA)
+	other := newSoftAuthenticator(t, AlgEdDSA)
+
+	challenge := randomBytes(t, 32)
+	credential, err := testConfig.VerifyRegistration(challenge, other.register(challenge, "none"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge = randomBytes(t, 32)
+	if _, err := testConfig.VerifyAssertion(challenge, authenticator.login(challenge), credential.PublicKey, 0); err == nil {
+		t.Fatal("assertion signed by another key was accepted")
+	}
+}
+
+func algName(alg int) string {
+	if alg == AlgEdDSA {
+		return "EdDSA"
+	}
+	return "ES256"
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// cborPair keeps map entries in order, authenticators use a fixed key order too.
+type cborPair struct {
+	key, value any
+}
+
+func cborEncode(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, cborEncode(pair.key)...)
+			out = append(out, cborEncode(pair.value)...)
+		}
+		return out
+	}
+	panic("cbor: unsupported type")
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+}